@@ -1,12 +1,15 @@
 package diskcache
 
 import (
-	"container/heap"
-	"errors"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"sort"
 	"sync"
 	"time"
 
@@ -22,14 +25,28 @@ type Cache interface {
 	Remove(key string)
 	Shutdown() error
 
+	// Admit reports whether a block fetched from upstream is worth
+	// storing. Put stores blocks whether or not they were admitted.
+	Admit(key string, size int64) bool
+	// Expires records when the object a block belongs to expires.
+	Expires(key string, expires time.Time)
+
 	GetFile(key string) (*os.File, error)
 }
 
+// New opens a disk cache in root that evicts the least recently hit
+// blocks.
 func New(root string, maxSize int64, cleanedSize int64) (Cache, error) {
+	return NewWithPolicy(root, maxSize, cleanedSize, newLRU())
+}
+
+// NewWithPolicy opens a disk cache in root that admits and evicts blocks
+// according to policy.
+func NewWithPolicy(root string, maxSize int64, cleanedSize int64, policy Policy) (Cache, error) {
 	cacheDBPath := path.Join(root, "cache.db")
 	db, err := bolt.Open(cacheDBPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		log.Panic("Unable to create or open cache.db", err)
+		return nil, err
 	}
 	dc := &diskCache{
 		db:          db,
@@ -39,11 +56,22 @@ func New(root string, maxSize int64, cleanedSize int64) (Cache, error) {
 		size:        int64(0),
 		dblock:      new(sync.RWMutex),
 		fslock:      new(sync.RWMutex),
+		policy:      policy,
+		sizes:       make(map[string]int64),
+		verified:    make(map[string]bool),
+		pending:     make(map[string]time.Time),
+		expires:     make(map[string]time.Time),
+		newExpires:  make(map[string]time.Time),
+		flushNow:    make(chan struct{}, 1),
+		cleanNow:    make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
 	}
-	dc.fixSize()
+	dc.load(dc.reconcile())
 	//log.Println("Disk Cache Size:", dc.size)
 	//log.Println("Cleaning keys...")
 	dc.clean()
+	go dc.run()
 	//log.Println("Disk Cache Size:", dc.size)
 	//log.Println(dc.cleanedSize)
 	//log.Println("Disk Cache Size:", dc.size)
@@ -52,219 +80,594 @@ func New(root string, maxSize int64, cleanedSize int64) (Cache, error) {
 	return dc, nil
 }
 
+// hitFlushInterval is how often buffered hits are written to the index,
+// sooner once maxPendingHits are buffered.
+const (
+	hitFlushInterval = 10 * time.Second
+	maxPendingHits   = 1024
+)
+
 type diskCache struct {
 	cleanedSize int64
 	maxSize     int64
 	root        string
-	size        int64
 
 	db     *bolt.DB
 	dblock *sync.RWMutex
 	fslock *sync.RWMutex
+
+	// lock guards size, the policy, the size of every block, the blocks
+	// verified since startup, the hits not yet written to the index and
+	// the expiries of blocks, with those not yet written to the index.
+	lock       sync.Mutex
+	size       int64
+	policy     Policy
+	sizes      map[string]int64
+	verified   map[string]bool
+	pending    map[string]time.Time
+	expires    map[string]time.Time
+	newExpires map[string]time.Time
+
+	flushNow chan struct{}
+	cleanNow chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	shutdown sync.Once
 }
 
 type entry struct {
 	key     string
 	lastHit time.Time
+	size    int64
+}
+
+// ChecksumMismatch is returned by Get when a block no longer matches the
+// checksum recorded when it was written. The block is removed.
+type ChecksumMismatch struct {
+	Key string
+}
+
+func (e ChecksumMismatch) Error() string {
+	return "Checksum mismatch: " + e.Key
 }
 
+// Get reads a whole block and verifies it against its checksum. Blocks
+// written before checksums were recorded are not verified.
 func (dc *diskCache) Get(key string) (io.ReadCloser, error) {
+	defer observeDuration("get", time.Now())
 	dc.Hit(key)
 	dc.fslock.RLock()
-	fi, err := os.Stat(path.Join(dc.root, key))
+	data, err := ioutil.ReadFile(dc.path(key))
 	dc.fslock.RUnlock()
 	if err != nil {
 		return nil, err
 	}
-	// HIT, return full range
-	return dc.GetRange(key, 0, fi.Size())
+	if expected := dc.checksum(key); expected != nil {
+		sum := sha256.Sum256(data)
+		if !bytes.Equal(sum[:], expected) {
+			return nil, dc.mismatch(key)
+		}
+	}
+	dc.setVerified(key)
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// checksum returns the checksum recorded when a block was written, nil for
+// blocks written before checksums were recorded.
+func (dc *diskCache) checksum(key string) []byte {
+	var expected []byte
+	dc.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte("key-checksums")); bucket != nil {
+			expected = append(expected, bucket.Get([]byte(key))...)
+		}
+		return nil
+	})
+	return expected
+}
+
+func (dc *diskCache) mismatch(key string) error {
+	log.Println("Checksum mismatch, removing", key)
+	diskCacheChecksumMismatches.Inc()
+	dc.Remove(key)
+	return ChecksumMismatch{Key: key}
+}
+
+func (dc *diskCache) setVerified(key string) {
+	dc.lock.Lock()
+	if _, ok := dc.sizes[key]; ok {
+		dc.verified[key] = true
+	}
+	dc.lock.Unlock()
 }
 
+// GetRange reads part of a block. It is not verified against its checksum.
 func (dc *diskCache) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
 	dc.Hit(key)
-	key = path.Join(dc.root, key)
 	dc.fslock.RLock()
-	defer dc.fslock.RUnlock()
-	_, err := os.Stat(key)
+	file, err := os.Open(dc.path(key))
+	dc.fslock.RUnlock()
 	if err != nil {
 		return nil, err
 	}
-	reader, writer := io.Pipe()
-	go func() {
-		dc.fslock.RLock()
-		defer dc.fslock.RUnlock()
-		file, err := os.Open(key)
-		if err != nil {
-			io.Copy(writer, file)
-			writer.CloseWithError(err)
+	return fileRange{SectionReader: io.NewSectionReader(file, offset, length), file: file}, nil
+}
+
+type fileRange struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (r fileRange) Close() error {
+	return r.file.Close()
+}
+
+// GetFile opens a block so it can be sent straight from its file, e.g. with
+// sendfile. A block is verified against its checksum the first time it is
+// read after startup, later reads trust the file.
+func (dc *diskCache) GetFile(key string) (*os.File, error) {
+	defer observeDuration("get_file", time.Now())
+	dc.Hit(key)
+	dc.fslock.RLock()
+	file, err := os.Open(dc.path(key))
+	dc.fslock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	dc.lock.Lock()
+	verified := dc.verified[key]
+	dc.lock.Unlock()
+	if verified {
+		return file, nil
+	}
+	if expected := dc.checksum(key); expected != nil {
+		sum := sha256.New()
+		_, err := io.Copy(sum, file)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
 		}
-		defer file.Close()
-		file.Seek(offset, 0)
-		_, err = io.CopyN(writer, file, length)
 		if err != nil {
-			writer.CloseWithError(err)
-		} else {
-			writer.Close()
+			file.Close()
+			return nil, err
+		}
+		if !bytes.Equal(sum.Sum(nil), expected) {
+			file.Close()
+			return nil, dc.mismatch(key)
 		}
-	}()
-	return reader, nil
+	}
+	dc.setVerified(key)
+	return file, nil
 }
 
-func (dc *diskCache) GetFile(key string) (*os.File, error) {
-	dc.Hit(key)
-	key = path.Join(dc.root, key)
-	return os.Open(key)
+// path returns where a block is stored. Blocks are spread over 256 shard
+// directories so no directory holds millions of files.
+func (dc *diskCache) path(key string) string {
+	return path.Join(dc.root, shard(key), key)
 }
 
+func shard(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:1])
+}
+
+// tempMarker is part of the name of blocks being written. Blocks are
+// written to a temp file, synced and then renamed into place, so a crash
+// never leaves a partial block under its final name.
+const tempMarker = ".tmp"
+
 func (dc *diskCache) Put(key string, reader io.Reader) error {
-	dc.fslock.Lock()
-	defer dc.fslock.Unlock()
-	key = path.Join(dc.root, key)
-	file, err := os.OpenFile(key, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	defer observeDuration("put", time.Now())
+	dir := path.Join(dc.root, shard(key))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, key+tempMarker)
 	if err != nil {
 		return err
 	}
-	n, err := io.Copy(file, reader)
+	checksum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, checksum), reader)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		file.Close()
-		os.RemoveAll(key)
+		os.Remove(file.Name())
 		return err
 	}
+
+	dc.fslock.Lock()
+	final := dc.path(key)
+	if _, err := os.Stat(final); err == nil {
+		dc.fslock.Unlock()
+		os.Remove(file.Name())
+		return &os.PathError{Op: "put", Path: final, Err: os.ErrExist}
+	}
+	if err := os.Rename(file.Name(), final); err != nil {
+		dc.fslock.Unlock()
+		os.Remove(file.Name())
+		return err
+	}
+	dc.lock.Lock()
+	if _, ok := dc.sizes[key]; ok {
+		dc.policy.Remove(key)
+		dc.unlink(key)
+	}
+	dc.policy.Add(key, n)
+	dc.sizes[key] = n
+	dc.verified[key] = true
 	dc.size = dc.size + n
+	size := dc.size
+	diskCacheSize.WithLabelValues(dc.root).Set(float64(size))
+	dc.lock.Unlock()
+	// reads only wait for the rename, not for the syncs below. An index
+	// entry written after the block was evicted is dropped by reconcile.
+	dc.fslock.Unlock()
+
+	if err := syncDir(dir); err != nil {
+		log.Println("Unable to sync", dir, err)
+	}
+	now := time.Now()
 	dc.dblock.Lock()
-	dc.db.Update(updateKeyTimestamp(key))
+	dc.db.Update(func(tx *bolt.Tx) error {
+		if err := updateKeyTimestamp(key, now)(tx); err != nil {
+			return err
+		}
+		return updateChecksum(key, checksum.Sum(nil))(tx)
+	})
 	dc.dblock.Unlock()
-	dc.clean()
+
+	// evict in the background, unless the cache outgrew its maximum
+	if size > dc.maxSize {
+		dc.clean()
+	} else if size > dc.cleanedSize {
+		signal(dc.cleanNow)
+	}
 	return nil
 }
 
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// syncDir makes renames in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Admit stores every block while the cache is under cleanedSize, and
+// otherwise asks the policy whether a block fetched from upstream is worth
+// storing. The policy is told about every fetch.
+func (dc *diskCache) Admit(key string, size int64) bool {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	admitted := dc.policy.Admit(key, size)
+	return admitted || dc.size+size <= dc.cleanedSize
+}
+
+// Expires tells the policy when the object of a block expires. The expiry
+// is written to the index with the next batch of hits, so it survives a
+// restart.
+func (dc *diskCache) Expires(key string, expires time.Time) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	if _, ok := dc.sizes[key]; !ok || dc.expires[key].Equal(expires) {
+		return
+	}
+	dc.policy.Expires(key, expires)
+	dc.expires[key] = expires
+	dc.newExpires[key] = expires
+}
+
+// Hit tells the policy about a read. The hit is written to the index with
+// the next batch.
 func (dc *diskCache) Hit(key string) error {
-	dc.dblock.Lock()
-	defer dc.dblock.Unlock()
-	dc.db.Update(updateKeyTimestamp(key))
+	dc.lock.Lock()
+	if _, ok := dc.sizes[key]; ok {
+		dc.policy.Hit(key)
+		dc.pending[key] = time.Now()
+	}
+	pending := len(dc.pending)
+	dc.lock.Unlock()
+	if pending >= maxPendingHits {
+		signal(dc.flushNow)
+	}
 	return nil
 }
 
-func (dc *diskCache) Shutdown() error {
-	return errors.New("Not Implemented")
+// run flushes hits and evicts blocks in the background until Shutdown.
+func (dc *diskCache) run() {
+	defer close(dc.stopped)
+	ticker := time.NewTicker(hitFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			dc.flush()
+		case <-dc.flushNow:
+			dc.flush()
+		case <-dc.cleanNow:
+			dc.clean()
+		case <-dc.done:
+			return
+		}
+	}
 }
 
-type entryHeap []entry
-
-func (h entryHeap) Len() int           { return len(h) }
-func (h entryHeap) Less(i, j int) bool { return h[i].lastHit.Before(h[j].lastHit) }
-func (h entryHeap) Swap(i, j int) {
-	h[i], h[j] = h[j], h[i]
+// flush writes the buffered hits and expiries to the index in one
+// transaction.
+func (dc *diskCache) flush() {
+	dc.lock.Lock()
+	pending := dc.pending
+	dc.pending = make(map[string]time.Time)
+	newExpires := dc.newExpires
+	dc.newExpires = make(map[string]time.Time)
+	dc.lock.Unlock()
+	if len(pending) == 0 && len(newExpires) == 0 {
+		return
+	}
+	defer observeDuration("flush", time.Now())
+	dc.dblock.Lock()
+	defer dc.dblock.Unlock()
+	err := dc.db.Update(func(tx *bolt.Tx) error {
+		for key, lastHit := range pending {
+			if err := updateKeyTimestamp(key, lastHit)(tx); err != nil {
+				return err
+			}
+		}
+		for key, expires := range newExpires {
+			if err := updateExpires(key, expires)(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Unable to record disk cache hits", err)
+	}
 }
-func (h *entryHeap) Push(x interface{}) { *h = append(*h, x.(entry)) }
-func (h *entryHeap) Pop() interface{} {
-	old := *h
-	n := len(old)
-	x := old[n-1]
-	*h = old[0 : n-1]
-	return x
+
+// Shutdown stops the background work, writes the buffered hits and
+// closes the index.
+func (dc *diskCache) Shutdown() error {
+	var err error
+	dc.shutdown.Do(func() {
+		close(dc.done)
+		<-dc.stopped
+		dc.flush()
+		err = dc.db.Close()
+	})
+	return err
 }
 
-func (dc *diskCache) fixSize() {
-	keys := &entryHeap{}
-	heap.Init(keys)
+// reconcile brings the index and the blocks on disk back in line after a
+// crash: temp files of interrupted writes are removed, index entries
+// without a block are dropped and blocks without an index entry are
+// indexed by their modification time. Blocks stored directly under the
+// root by earlier versions are moved into their shard. It returns the size
+// of every block.
+func (dc *diskCache) reconcile() map[string]int64 {
+	indexed := make(map[string]bool)
+	var missing []string
 	dc.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("key-timestamps"))
 		if bucket == nil {
 			return nil
 		}
 		c := bucket.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			var t time.Time
-			err := t.UnmarshalBinary(v)
-			if err == nil {
-				key := entry{
-					key:     string(k),
-					lastHit: t,
-				}
-				heap.Push(keys, key)
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			key := string(k)
+			if strings.Contains(key, "/") {
+				missing = append(missing, key)
+			} else if _, err := os.Stat(dc.path(key)); err == nil {
+				indexed[key] = true
+			} else if _, err := os.Stat(path.Join(dc.root, key)); err == nil {
+				// unsharded, moved below
+				indexed[key] = true
+			} else {
+				missing = append(missing, key)
 			}
 		}
 		return nil
 	})
-	totalSize := int64(0)
-	for keys.Len() > 0 {
-		key := keys.Pop().(entry)
-		info, err := os.Stat(path.Join(dc.root, key.key))
-		if err == nil {
-			totalSize = totalSize + info.Size()
-		} else if os.IsNotExist(err) {
-			dc.db.Update(remove(key.key))
+	for _, key := range missing {
+		dc.db.Update(remove(key))
+	}
+
+	files, err := ioutil.ReadDir(dc.root)
+	if err != nil {
+		log.Println("Unable to read", dc.root, err)
+	}
+	sizes := make(map[string]int64)
+	for _, info := range files {
+		name := info.Name()
+		if info.IsDir() {
+			// only shards, roots may be mount points with lost+found
+			if _, err := hex.DecodeString(name); err == nil && len(name) == 2 {
+				dc.reconcileDir(path.Join(dc.root, name), indexed, sizes)
+			}
+			continue
+		}
+		if name == "cache.db" {
+			continue
+		}
+		if dc.reconcileFile(path.Join(dc.root, name), info, indexed) {
+			if err := os.MkdirAll(path.Join(dc.root, shard(name)), 0700); err == nil {
+				err = os.Rename(path.Join(dc.root, name), dc.path(name))
+			}
+			if err != nil {
+				log.Println("Unable to move", name, "into its shard", err)
+			}
+			sizes[name] = info.Size()
 		}
 	}
-	//log.Println("totalSize", totalSize)
-	dc.size = totalSize
+	return sizes
 }
 
-func (dc *diskCache) clean() {
-	//log.Println("clean called")
-	keys := &entryHeap{}
-	heap.Init(keys)
+func (dc *diskCache) reconcileDir(dir string, indexed map[string]bool, sizes map[string]int64) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Println("Unable to read", dir, err)
+		return
+	}
+	for _, info := range files {
+		if !info.IsDir() && dc.reconcileFile(path.Join(dir, info.Name()), info, indexed) {
+			sizes[info.Name()] = info.Size()
+		}
+	}
+}
+
+// reconcileFile removes temp files and indexes unindexed blocks. It
+// returns whether the file is a block.
+func (dc *diskCache) reconcileFile(file string, info os.FileInfo, indexed map[string]bool) bool {
+	name := info.Name()
+	if strings.Contains(name, tempMarker) {
+		log.Println("Removing incomplete block", name)
+		os.Remove(file)
+		return false
+	}
+	if !indexed[name] {
+		dc.db.Update(updateKeyTimestamp(name, info.ModTime()))
+	}
+	return true
+}
+
+// load adds the blocks found by reconcile to the policy, least recently
+// hit first, with their expiries. Only hit times are kept, policies
+// counting hits start over.
+func (dc *diskCache) load(sizes map[string]int64) {
+	var entries []*entry
+	expires := make(map[string]time.Time)
 	dc.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte("key-expires")); bucket != nil {
+			bucket.ForEach(func(k, v []byte) error {
+				var expiry time.Time
+				if expiry.UnmarshalBinary(v) == nil {
+					expires[string(k)] = expiry
+				}
+				return nil
+			})
+		}
 		bucket := tx.Bucket([]byte("key-timestamps"))
 		if bucket == nil {
 			return nil
 		}
-		c := bucket.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			var t time.Time
-			err := t.UnmarshalBinary(v)
-			if err == nil {
-				key := entry{
-					key:     string(k),
-					lastHit: t,
-				}
-				heap.Push(keys, key)
+		return bucket.ForEach(func(k, v []byte) error {
+			size, ok := sizes[string(k)]
+			var lastHit time.Time
+			if ok && lastHit.UnmarshalBinary(v) == nil {
+				entries = append(entries, &entry{key: string(k), lastHit: lastHit, size: size})
 			}
-		}
-		return nil
+			return nil
+		})
 	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastHit.Before(entries[j].lastHit) })
+
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	dc.size = 0
+	for _, e := range entries {
+		dc.policy.Add(e.key, e.size)
+		dc.sizes[e.key] = e.size
+		dc.size = dc.size + e.size
+		if expiry, ok := expires[e.key]; ok {
+			dc.policy.Expires(e.key, expiry)
+			dc.expires[e.key] = expiry
+		}
+	}
+	diskCacheSize.WithLabelValues(dc.root).Set(float64(dc.size))
+}
 
-	//log.Println(dc.size, dc.cleanedSize)
-	//log.Println(keys)
+// clean evicts the blocks chosen by the policy until the cache is under
+// cleanedSize.
+func (dc *diskCache) clean() {
+	for {
+		var victims []string
+		dc.lock.Lock()
+		for dc.size > dc.cleanedSize && len(victims) < 256 {
+			key, ok := dc.policy.Evict()
+			if !ok {
+				break
+			}
+			dc.unlink(key)
+			victims = append(victims, key)
+		}
+		diskCacheSize.WithLabelValues(dc.root).Set(float64(dc.size))
+		dc.lock.Unlock()
+		if len(victims) == 0 {
+			return
+		}
 
-	for dc.size > dc.cleanedSize {
-		//log.Println("cleaning: ", dc.size, ">", dc.cleanedSize)
-		//log.Println()
-		//log.Println("Before ---")
-		//log.Println(keys)
-		//log.Println()
-		key := heap.Pop(keys).(entry)
-		dc.Remove(key.key)
-		//log.Println()
-		//log.Println("After --- ")
-		//log.Println(keys)
-		//log.Println()
+		dc.fslock.Lock()
+		for _, victim := range victims {
+			if err := os.Remove(dc.path(victim)); err != nil && !os.IsNotExist(err) {
+				log.Println(err)
+			}
+		}
+		dc.fslock.Unlock()
+		dc.dblock.Lock()
+		dc.db.Update(func(tx *bolt.Tx) error {
+			for _, victim := range victims {
+				if err := remove(victim)(tx); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		dc.dblock.Unlock()
+		diskCacheEvictions.Add(float64(len(victims)))
 	}
 }
 
+// unlink drops a block the policy no longer tracks from the size. The lock
+// must be held.
+func (dc *diskCache) unlink(key string) {
+	dc.size = dc.size - dc.sizes[key]
+	delete(dc.sizes, key)
+	delete(dc.verified, key)
+	delete(dc.pending, key)
+	delete(dc.expires, key)
+	delete(dc.newExpires, key)
+}
+
 func (dc *diskCache) Remove(key string) {
-	file := key
-	if !strings.HasPrefix(key, dc.root) {
-		file = path.Join(dc.root, key)
-	}
-	info, err := os.Stat(file)
-	if err != nil {
-		log.Println(err)
-		return
+	dc.lock.Lock()
+	if _, ok := dc.sizes[key]; ok {
+		dc.policy.Remove(key)
+		dc.unlink(key)
+		diskCacheSize.WithLabelValues(dc.root).Set(float64(dc.size))
 	}
-	err = os.Remove(file)
+	dc.lock.Unlock()
+
+	dc.fslock.Lock()
+	err := os.Remove(dc.path(key))
+	dc.fslock.Unlock()
 	if err != nil {
-		log.Println(err)
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
 		return
 	}
+	dc.dblock.Lock()
 	dc.db.Update(remove(key))
-	dc.size = dc.size - info.Size()
+	dc.dblock.Unlock()
 }
 
-func updateKeyTimestamp(key string) func(tx *bolt.Tx) error {
+func observeDuration(operation string, start time.Time) {
+	diskCacheDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func updateKeyTimestamp(key string, updateTime time.Time) func(tx *bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
-		updateTime := time.Now()
 		binaryUpdateTime, err := updateTime.MarshalBinary()
 		if err != nil {
 			return err
@@ -277,12 +680,41 @@ func updateKeyTimestamp(key string) func(tx *bolt.Tx) error {
 	}
 }
 
-func remove(key string) func(tx *bolt.Tx) error {
+func updateChecksum(key string, checksum []byte) func(tx *bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte("key-timestamps"))
+		bucket, err := tx.CreateBucketIfNotExists([]byte("key-checksums"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), checksum)
+	}
+}
+
+func updateExpires(key string, expires time.Time) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		binaryExpires, err := expires.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucketIfNotExists([]byte("key-expires"))
 		if err != nil {
 			return err
 		}
-		return bucket.Delete([]byte(key))
+		return bucket.Put([]byte(key), binaryExpires)
+	}
+}
+
+func remove(key string) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		for _, name := range []string{"key-timestamps", "key-checksums", "key-expires"} {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 }
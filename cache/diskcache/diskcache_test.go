@@ -0,0 +1,277 @@
+package diskcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCache(t *testing.T, root string) *diskCache {
+	cache, err := New(root, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache.(*diskCache)
+}
+
+func TestPutGet(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cache := newTestCache(t, root)
+	defer cache.Shutdown()
+
+	assert.Nil(t, cache.Put("block-0", bytes.NewReader([]byte("hello"))))
+	assert.NotNil(t, cache.Put("block-0", bytes.NewReader([]byte("again"))))
+	reader, err := cache.Get("block-0")
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, "hello", string(data))
+	assert.Equal(t, int64(5), cache.size)
+
+	files, _ := ioutil.ReadDir(root)
+	assert.Len(t, files, 2, "only cache.db and the block")
+}
+
+func TestReconcile(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cache := newTestCache(t, root)
+	assert.Nil(t, cache.Put("indexed-0", bytes.NewReader([]byte("hello"))))
+	assert.Nil(t, cache.Put("deleted-0", bytes.NewReader([]byte("hello"))))
+	cache.Shutdown()
+
+	// A crash mid-write, a block renamed but not indexed and a block lost.
+	ioutil.WriteFile(path.Join(root, "partial-0"+tempMarker+"123"), []byte("hel"), 0600)
+	ioutil.WriteFile(path.Join(root, "unindexed-0"), []byte("hello world"), 0600)
+	os.Remove(cache.path("deleted-0"))
+
+	cache = newTestCache(t, root)
+	defer cache.Shutdown()
+	_, err = os.Stat(path.Join(root, "partial-0"+tempMarker+"123"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int64(16), cache.size)
+
+	var keys []string
+	cache.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("key-timestamps")).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	assert.Equal(t, []string{"indexed-0", "unindexed-0"}, keys)
+	_, err = os.Stat(cache.path("unindexed-0"))
+	assert.Nil(t, err, "moved into its shard")
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cache := newTestCache(t, root)
+	defer cache.Shutdown()
+
+	assert.Nil(t, cache.Put("block-0", bytes.NewReader([]byte("hello"))))
+	ioutil.WriteFile(cache.path("block-0"), []byte("jello"), 0600)
+
+	_, err = cache.Get("block-0")
+	assert.Equal(t, ChecksumMismatch{Key: "block-0"}, err)
+	_, err = os.Stat(cache.path("block-0"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int64(0), cache.size)
+}
+
+func TestGetFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cache := newTestCache(t, root)
+	assert.Nil(t, cache.Put("block-0", bytes.NewReader([]byte("hello"))))
+	assert.Nil(t, cache.Put("block-1", bytes.NewReader([]byte("world"))))
+
+	file, err := cache.GetFile("block-0")
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadAll(file)
+	file.Close()
+	assert.Equal(t, "hello", string(data))
+	reader, err := cache.GetRange("block-0", 1, 3)
+	assert.Nil(t, err)
+	data, _ = ioutil.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "ell", string(data))
+	cache.Shutdown()
+
+	// Blocks are verified on their first read after startup.
+	ioutil.WriteFile(cache.path("block-1"), []byte("wurld"), 0600)
+	cache = newTestCache(t, root)
+	defer cache.Shutdown()
+	_, err = cache.GetFile("block-1")
+	assert.Equal(t, ChecksumMismatch{Key: "block-1"}, err)
+	file, err = cache.GetFile("block-0")
+	assert.Nil(t, err)
+	data, _ = ioutil.ReadAll(file)
+	file.Close()
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestEviction(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cache, err := New(root, 30, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := cache.(*diskCache)
+	defer dc.Shutdown()
+
+	assert.Nil(t, dc.Put("block-0", bytes.NewReader([]byte("0123456789"))))
+	assert.Nil(t, dc.Put("block-1", bytes.NewReader([]byte("0123456789"))))
+	dc.Hit("block-0")
+	// over cleanedSize, evicted in the background
+	assert.Nil(t, dc.Put("block-2", bytes.NewReader([]byte("0123456789"))))
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		dc.lock.Lock()
+		size := dc.size
+		dc.lock.Unlock()
+		if size == 20 {
+			break
+		}
+	}
+	_, err = os.Stat(dc.path("block-1"))
+	assert.True(t, os.IsNotExist(err), "least recently hit")
+
+	// over maxSize, evicted before Put returns
+	assert.Nil(t, dc.Put("block-3", bytes.NewReader(make([]byte, 15))))
+	dc.lock.Lock()
+	assert.Equal(t, int64(15), dc.size)
+	dc.lock.Unlock()
+}
+
+func TestHitsFlushed(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cache := newTestCache(t, root)
+	assert.Nil(t, cache.Put("block-0", bytes.NewReader([]byte("hello"))))
+	assert.Nil(t, cache.Put("block-1", bytes.NewReader([]byte("hello"))))
+	cache.Hit("block-0")
+	cache.Hit("missing")
+	assert.Nil(t, cache.Shutdown())
+
+	cache = newTestCache(t, root)
+	defer cache.Shutdown()
+	assert.Len(t, cache.sizes, 2)
+	key, _ := cache.policy.Evict()
+	assert.Equal(t, "block-1", key, "block-0 was hit last")
+}
+
+func TestExpiresPersisted(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	open := func() *diskCache {
+		cache, err := NewWithPolicy(root, 1<<20, 1<<20, newExpiredFirst(time.Now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cache.(*diskCache)
+	}
+	cache := open()
+	assert.Nil(t, cache.Put("block-0", bytes.NewReader([]byte("hello"))))
+	assert.Nil(t, cache.Put("block-1", bytes.NewReader([]byte("hello"))))
+	cache.Hit("block-0")
+	cache.Expires("block-0", time.Now().Add(-time.Hour))
+	assert.Nil(t, cache.Shutdown())
+
+	// the expired block is evicted first after a restart, although hit last
+	cache = open()
+	defer cache.Shutdown()
+	key, _ := cache.policy.Evict()
+	assert.Equal(t, "block-0", key)
+}
+
+func TestAdmitWithRoom(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cache, err := NewWithPolicy(root, 20, 10, newTinyLFU())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Shutdown()
+
+	assert.True(t, cache.Admit("block-0", 5))
+	assert.Nil(t, cache.Put("block-0", bytes.NewReader([]byte("hello"))))
+	assert.True(t, cache.Admit("block-1", 5), "fits under cleanedSize")
+	assert.Nil(t, cache.Put("block-1", bytes.NewReader([]byte("hello"))))
+	cache.Hit("block-0")
+	cache.Hit("block-1")
+	assert.False(t, cache.Admit("block-2", 5), "full, and requested less than the lru block")
+}
+
+func TestGetDuringPut(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cache := newTestCache(t, root)
+	defer cache.Shutdown()
+	assert.Nil(t, cache.Put("block-0", bytes.NewReader([]byte("hello"))))
+
+	// A Put stuck on the index, as behind a slow sync, after its rename.
+	cache.dblock.Lock()
+	put := make(chan error)
+	go func() {
+		put <- cache.Put("block-1", bytes.NewReader([]byte("world")))
+	}()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if _, err := os.Stat(cache.path("block-1")); err == nil {
+			break
+		}
+	}
+
+	read := make(chan error)
+	go func() {
+		reader, err := cache.Get("block-0")
+		if err == nil {
+			reader.Close()
+		}
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Error("Get waited for Put")
+		cache.dblock.Unlock()
+		<-read
+		cache.dblock.Lock()
+	}
+	cache.dblock.Unlock()
+	assert.Nil(t, <-put)
+}
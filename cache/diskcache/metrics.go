@@ -0,0 +1,43 @@
+package diskcache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	diskCacheSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "casserole",
+		Subsystem: "disk_cache",
+		Name:      "size_bytes",
+		Help:      "Bytes stored in each disk cache root.",
+	}, []string{"root"})
+	diskCacheVolumeUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "casserole",
+		Subsystem: "disk_cache",
+		Name:      "volume_up",
+		Help:      "Whether a disk cache root is in rotation (1) or failed (0).",
+	}, []string{"root"})
+	diskCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "casserole",
+		Subsystem: "disk_cache",
+		Name:      "evictions_total",
+		Help:      "Blocks evicted from the disk cache to stay under its maximum size.",
+	})
+	diskCacheChecksumMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "casserole",
+		Subsystem: "disk_cache",
+		Name:      "checksum_mismatches_total",
+		Help:      "Blocks read from disk that did not match their checksum and were removed.",
+	})
+	diskCacheDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "casserole",
+		Subsystem: "disk_cache",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of disk cache operations.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(diskCacheSize, diskCacheVolumeUp, diskCacheEvictions, diskCacheChecksumMismatches, diskCacheDuration)
+}
@@ -0,0 +1,383 @@
+package diskcache
+
+import (
+	"container/heap"
+	"container/list"
+	"errors"
+	"hash/fnv"
+	"time"
+)
+
+// Policy decides which blocks the disk cache stores and which it evicts
+// first. The disk cache serializes calls, policies need no locking.
+type Policy interface {
+	// Admit reports whether a block fetched from upstream is worth
+	// storing in place of the block Evict would return. It is asked about
+	// every fetch, also while the disk cache has room.
+	Admit(key string, size int64) bool
+	// Add tracks a stored block.
+	Add(key string, size int64)
+	// Hit records a read of a block.
+	Hit(key string)
+	// Expires records when the object a block belongs to expires.
+	Expires(key string, expires time.Time)
+	// Remove stops tracking a block, e.g. after a purge.
+	Remove(key string)
+	// Evict stops tracking the block to evict next and returns it.
+	Evict() (string, bool)
+}
+
+// Policies are the names accepted by NewPolicy.
+var Policies = []string{"lru", "lfu", "gdsf", "tinylfu", "expired-first"}
+
+// NewPolicy returns a policy by name:
+//
+//	lru            evicts the least recently hit block
+//	lfu            evicts the least frequently hit block
+//	gdsf           evicts by frequency over size, aged as blocks are evicted
+//	tinylfu        lru that, when full, only stores blocks requested more
+//	               often than the block they would evict
+//	expired-first  evicts blocks of expired objects, then lru
+func NewPolicy(name string) (Policy, error) {
+	switch name {
+	case "lru":
+		return newLRU(), nil
+	case "lfu":
+		return newLFU(), nil
+	case "gdsf":
+		return newGDSF(), nil
+	case "tinylfu":
+		return newTinyLFU(), nil
+	case "expired-first":
+		return newExpiredFirst(time.Now), nil
+	}
+	return nil, errors.New("unknown disk cache policy: " + name)
+}
+
+type lru struct {
+	order   *list.List // most recently hit first
+	entries map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (p *lru) Admit(key string, size int64) bool { return true }
+
+func (p *lru) Add(key string, size int64) {
+	if element, ok := p.entries[key]; ok {
+		p.order.MoveToFront(element)
+		return
+	}
+	p.entries[key] = p.order.PushFront(key)
+}
+
+func (p *lru) Hit(key string) {
+	if element, ok := p.entries[key]; ok {
+		p.order.MoveToFront(element)
+	}
+}
+
+func (p *lru) Expires(key string, expires time.Time) {}
+
+func (p *lru) Remove(key string) {
+	if element, ok := p.entries[key]; ok {
+		p.order.Remove(element)
+		delete(p.entries, key)
+	}
+}
+
+func (p *lru) Evict() (string, bool) {
+	element := p.order.Back()
+	if element == nil {
+		return "", false
+	}
+	key := element.Value.(string)
+	p.Remove(key)
+	return key, true
+}
+
+// ranked is a block in a priorityQueue, the lowest priority is evicted
+// first and ties go to the least recently touched.
+type ranked struct {
+	key      string
+	priority float64
+	count    int64
+	size     int64
+	touched  uint64
+	index    int
+}
+
+type priorityQueue []*ranked
+
+func (q priorityQueue) Len() int { return len(q) }
+func (q priorityQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].touched < q[j].touched
+}
+func (q priorityQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *priorityQueue) Push(x interface{}) {
+	item := x.(*ranked)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+func (q *priorityQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[0 : n-1]
+	return item
+}
+
+// ranking keeps blocks ordered by a priority computed from their hit count
+// and size.
+type ranking struct {
+	queue    priorityQueue
+	entries  map[string]*ranked
+	clock    uint64
+	priority func(item *ranked) float64
+}
+
+func newRanking(priority func(item *ranked) float64) *ranking {
+	return &ranking{entries: make(map[string]*ranked), priority: priority}
+}
+
+func (p *ranking) Admit(key string, size int64) bool { return true }
+
+func (p *ranking) Add(key string, size int64) {
+	if _, ok := p.entries[key]; ok {
+		p.Hit(key)
+		return
+	}
+	p.clock++
+	item := &ranked{key: key, count: 1, size: size, touched: p.clock}
+	item.priority = p.priority(item)
+	p.entries[key] = item
+	heap.Push(&p.queue, item)
+}
+
+func (p *ranking) Hit(key string) {
+	item, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	p.clock++
+	item.count++
+	item.touched = p.clock
+	item.priority = p.priority(item)
+	heap.Fix(&p.queue, item.index)
+}
+
+func (p *ranking) Expires(key string, expires time.Time) {}
+
+func (p *ranking) Remove(key string) {
+	if item, ok := p.entries[key]; ok {
+		heap.Remove(&p.queue, item.index)
+		delete(p.entries, key)
+	}
+}
+
+func (p *ranking) Evict() (string, bool) {
+	if len(p.queue) == 0 {
+		return "", false
+	}
+	item := heap.Pop(&p.queue).(*ranked)
+	delete(p.entries, item.key)
+	return item.key, true
+}
+
+func newLFU() *ranking {
+	return newRanking(func(item *ranked) float64 {
+		return float64(item.count)
+	})
+}
+
+// gdsf is Greedy-Dual-Size-Frequency: a block's priority is its hit count
+// over its size plus the priority of the last evicted block, so small hot
+// blocks stay longest and blocks that stop being hit age out.
+type gdsf struct {
+	*ranking
+	inflation float64
+}
+
+func newGDSF() *gdsf {
+	p := &gdsf{}
+	p.ranking = newRanking(func(item *ranked) float64 {
+		size := item.size
+		if size < 1 {
+			size = 1
+		}
+		// per MB, so priorities stay well within float precision
+		return p.inflation + float64(item.count)*(1<<20)/float64(size)
+	})
+	return p
+}
+
+func (p *gdsf) Evict() (string, bool) {
+	if len(p.queue) == 0 {
+		return "", false
+	}
+	p.inflation = p.queue[0].priority
+	return p.ranking.Evict()
+}
+
+// tinyLFU is lru that only admits blocks requested more often recently
+// than the block they would evict, so one-off downloads do not flush blocks
+// in use. Fetches and hits are counted in a count-min sketch that is halved
+// periodically.
+type tinyLFU struct {
+	*lru
+	sketch    [sketchDepth][sketchWidth]uint8
+	additions int
+}
+
+const (
+	sketchDepth = 4
+	sketchWidth = 1 << 16
+	// sketchReset is how many counts are kept before halving all counters.
+	sketchReset = 10 * sketchWidth
+)
+
+func newTinyLFU() *tinyLFU {
+	return &tinyLFU{lru: newLRU()}
+}
+
+func (p *tinyLFU) Admit(key string, size int64) bool {
+	count := p.increment(key)
+	victim := p.lru.order.Back()
+	return victim == nil || count > p.estimate(victim.Value.(string))
+}
+
+func (p *tinyLFU) Hit(key string) {
+	p.increment(key)
+	p.lru.Hit(key)
+}
+
+// counters returns the counters of a key, one per row of the sketch.
+func (p *tinyLFU) counters(key string) [sketchDepth]*uint8 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	var counters [sketchDepth]*uint8
+	for i := range counters {
+		counters[i] = &p.sketch[i][(h1+uint32(i)*h2)%sketchWidth]
+	}
+	return counters
+}
+
+// estimate returns the estimated request count of a key.
+func (p *tinyLFU) estimate(key string) uint8 {
+	estimate := uint8(255)
+	for _, counter := range p.counters(key) {
+		if *counter < estimate {
+			estimate = *counter
+		}
+	}
+	return estimate
+}
+
+// increment counts a request and returns the estimated request count.
+func (p *tinyLFU) increment(key string) uint8 {
+	for _, counter := range p.counters(key) {
+		if *counter < 255 {
+			*counter++
+		}
+	}
+	estimate := p.estimate(key)
+	p.additions++
+	if p.additions >= sketchReset {
+		p.additions = 0
+		for i := range p.sketch {
+			for j := range p.sketch[i] {
+				p.sketch[i][j] /= 2
+			}
+		}
+	}
+	return estimate
+}
+
+// expiredFirst evicts blocks of expired objects, soonest expired first,
+// then falls back to lru. Blocks without a known expiry are never
+// considered expired.
+type expiredFirst struct {
+	*lru
+	expiring expiryQueue
+	entries  map[string]*expiring
+	now      func() time.Time
+}
+
+type expiring struct {
+	key     string
+	expires time.Time
+	index   int
+}
+
+type expiryQueue []*expiring
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].expires.Before(q[j].expires) }
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *expiryQueue) Push(x interface{}) {
+	item := x.(*expiring)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[0 : n-1]
+	return item
+}
+
+func newExpiredFirst(now func() time.Time) *expiredFirst {
+	return &expiredFirst{lru: newLRU(), entries: make(map[string]*expiring), now: now}
+}
+
+func (p *expiredFirst) Expires(key string, expires time.Time) {
+	if _, ok := p.lru.entries[key]; !ok {
+		return
+	}
+	if item, ok := p.entries[key]; ok {
+		item.expires = expires
+		heap.Fix(&p.expiring, item.index)
+		return
+	}
+	item := &expiring{key: key, expires: expires}
+	p.entries[key] = item
+	heap.Push(&p.expiring, item)
+}
+
+func (p *expiredFirst) Remove(key string) {
+	p.lru.Remove(key)
+	if item, ok := p.entries[key]; ok {
+		heap.Remove(&p.expiring, item.index)
+		delete(p.entries, key)
+	}
+}
+
+func (p *expiredFirst) Evict() (string, bool) {
+	if len(p.expiring) > 0 && p.expiring[0].expires.Before(p.now()) {
+		key := p.expiring[0].key
+		p.Remove(key)
+		return key, true
+	}
+	key, ok := p.lru.Evict()
+	if item, found := p.entries[key]; ok && found {
+		heap.Remove(&p.expiring, item.index)
+		delete(p.entries, key)
+	}
+	return key, ok
+}
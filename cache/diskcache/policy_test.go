@@ -0,0 +1,92 @@
+package diskcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func evictAll(policy Policy) []string {
+	var keys []string
+	for {
+		key, ok := policy.Evict()
+		if !ok {
+			return keys
+		}
+		keys = append(keys, key)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	policy := newLRU()
+	policy.Add("a", 1)
+	policy.Add("b", 1)
+	policy.Add("c", 1)
+	policy.Hit("a")
+	policy.Remove("c")
+	assert.Equal(t, []string{"b", "a"}, evictAll(policy))
+}
+
+func TestLFU(t *testing.T) {
+	policy := newLFU()
+	policy.Add("a", 1)
+	policy.Add("b", 1)
+	policy.Add("c", 1)
+	policy.Hit("a")
+	policy.Hit("a")
+	policy.Hit("b")
+	assert.Equal(t, []string{"c", "b", "a"}, evictAll(policy))
+}
+
+func TestGDSF(t *testing.T) {
+	policy := newGDSF()
+	policy.Add("large", 2<<20)
+	policy.Add("small", 1<<20)
+	policy.Add("hot-large", 2<<20)
+	policy.Hit("hot-large")
+	policy.Hit("hot-large")
+	key, _ := policy.Evict()
+	assert.Equal(t, "large", key)
+
+	// evictions age the blocks left, so new blocks outrank them
+	policy.Add("new", 2<<20)
+	assert.Equal(t, []string{"small", "new", "hot-large"}, evictAll(policy))
+}
+
+func TestTinyLFU(t *testing.T) {
+	policy := newTinyLFU()
+	assert.True(t, policy.Admit("a", 1), "nothing to evict")
+	policy.Add("a", 1)
+	assert.False(t, policy.Admit("b", 1), "requested as often as a")
+	assert.True(t, policy.Admit("b", 1), "requested more often than a")
+	policy.Hit("a")
+	policy.Hit("a")
+	assert.False(t, policy.Admit("c", 1))
+	assert.False(t, policy.Admit("c", 1))
+	assert.Equal(t, []string{"a"}, evictAll(policy))
+}
+
+func TestExpiredFirst(t *testing.T) {
+	now := time.Now()
+	policy := newExpiredFirst(func() time.Time { return now })
+	policy.Add("a", 1)
+	policy.Add("b", 1)
+	policy.Add("c", 1)
+	policy.Add("d", 1)
+	policy.Expires("b", now.Add(-time.Hour))
+	policy.Expires("c", now.Add(-time.Minute))
+	policy.Expires("d", now.Add(time.Hour))
+	policy.Hit("a")
+	assert.Equal(t, []string{"b", "c", "d", "a"}, evictAll(policy))
+	assert.Len(t, policy.entries, 0)
+}
+
+func TestNewPolicy(t *testing.T) {
+	for _, name := range Policies {
+		_, err := NewPolicy(name)
+		assert.Nil(t, err, name)
+	}
+	_, err := NewPolicy("fifo")
+	assert.NotNil(t, err)
+}
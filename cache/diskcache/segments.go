@@ -0,0 +1,611 @@
+package diskcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSegmentSize is the size at which segments are sealed.
+const DefaultSegmentSize = 256 * 1024 * 1024
+
+// minSegmentSize keeps small caches from sealing a segment per record.
+const minSegmentSize = 1024 * 1024
+
+const (
+	segmentSuffix = ".seg"
+	recordMagic   = 0x63736567 // "cseg"
+	recordBlock   = 1
+	recordRemoved = 2
+	// magic, type, key length, data length, sha256 of key and data
+	recordHeaderSize = 4 + 1 + 2 + 8 + sha256.Size
+)
+
+// segmentCache is a log-structured disk cache. Blocks are appended to
+// large segment files and located through an in-memory index rebuilt from
+// the segments on startup, so there is no file or bolt row per block.
+// Removals append a tombstone.
+//
+// Segments are evicted whole, oldest first, in the background. Blocks of an
+// evicted segment that were hit since they were written are copied to the
+// active segment, up to half the segment, the others are dropped. Hits are
+// only kept in memory, after a restart every block starts cold.
+//
+// Locks are taken in the order cleanLock, writeLock, lock. Reads only take
+// lock, which is never held while writing or syncing a segment.
+type segmentCache struct {
+	root        string
+	maxSize     int64
+	cleanedSize int64
+	segmentSize int64
+
+	// cleanLock serializes evictions.
+	cleanLock sync.Mutex
+	// writeLock serializes appends to the active segment.
+	writeLock sync.Mutex
+	// lock guards the index, the segments and size.
+	lock     sync.Mutex
+	index    map[string]*location
+	segments []*segment // oldest first, the last one is active
+	size     int64
+
+	// clean wakes the compactor, done stops it.
+	clean    chan struct{}
+	done     chan struct{}
+	shutdown sync.Once
+}
+
+type segment struct {
+	id   uint64
+	file *os.File
+	size int64
+	keys map[string]bool
+	// refs counts open readers, an evicted segment is closed by the last
+	refs    int
+	evicted bool
+}
+
+type location struct {
+	segment  *segment
+	offset   int64 // of the data
+	length   int64
+	checksum [sha256.Size]byte
+	hit      bool
+}
+
+// NewSegments opens a segment store in root, sealing segments at
+// DefaultSegmentSize or an eighth of cleanedSize, whichever is smaller, but
+// no smaller than a megabyte.
+func NewSegments(root string, maxSize int64, cleanedSize int64) (Cache, error) {
+	segmentSize := int64(DefaultSegmentSize)
+	if cleanedSize/8 < segmentSize {
+		segmentSize = cleanedSize / 8
+	}
+	if segmentSize < minSegmentSize {
+		segmentSize = minSegmentSize
+	}
+	sc := &segmentCache{
+		root:        root,
+		maxSize:     maxSize,
+		cleanedSize: cleanedSize,
+		segmentSize: segmentSize,
+		index:       make(map[string]*location),
+		clean:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	if err := sc.load(); err != nil {
+		sc.Shutdown()
+		return nil, err
+	}
+	sc.evict()
+	go sc.compactor()
+	return sc, nil
+}
+
+// compactor evicts segments in the background whenever it is woken.
+func (sc *segmentCache) compactor() {
+	for {
+		select {
+		case <-sc.clean:
+			sc.evict()
+		case <-sc.done:
+			return
+		}
+	}
+}
+
+// load replays the segments in order. A record cut short by a crash can
+// only be at the end of the newest segment. Segments are truncated at the
+// first record that cannot be read.
+func (sc *segmentCache) load() error {
+	files, err := ioutil.ReadDir(sc.root)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, info := range files {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for i, id := range ids {
+		file, err := os.OpenFile(sc.segmentPath(id), os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		seg := &segment{id: id, file: file, keys: make(map[string]bool)}
+		sc.segments = append(sc.segments, seg)
+		if err := sc.replay(seg, i == len(ids)-1); err != nil {
+			return err
+		}
+		sc.size += seg.size
+	}
+	if len(sc.segments) == 0 {
+		if err := sc.rotate(); err != nil {
+			return err
+		}
+	}
+	diskCacheSize.WithLabelValues(sc.root).Set(float64(sc.size))
+	return nil
+}
+
+// replay indexes the records of a segment. Data is only verified for the
+// newest segment, other segments are verified as blocks are read.
+func (sc *segmentCache) replay(seg *segment, newest bool) error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+	offset := int64(0)
+	for offset < end {
+		recordType, key, length, checksum, err := readRecordHeader(seg.file, offset, end)
+		if err == nil && newest {
+			err = verifyRecord(seg.file, offset, key, length, checksum)
+		}
+		if err != nil {
+			log.Println("Truncating segment", seg.file.Name(), "at", offset, err)
+			if err := seg.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if old, ok := sc.index[key]; ok {
+			delete(old.segment.keys, key)
+			delete(sc.index, key)
+		}
+		dataOffset := offset + recordHeaderSize + int64(len(key))
+		if recordType == recordBlock {
+			sc.index[key] = &location{segment: seg, offset: dataOffset, length: length, checksum: checksum}
+			seg.keys[key] = true
+		}
+		offset = dataOffset + length
+	}
+	seg.size = offset
+	return nil
+}
+
+func readRecordHeader(file *os.File, offset, end int64) (byte, string, int64, [sha256.Size]byte, error) {
+	var checksum [sha256.Size]byte
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return 0, "", 0, checksum, err
+	}
+	if binary.BigEndian.Uint32(header) != recordMagic {
+		return 0, "", 0, checksum, errors.New("bad record magic")
+	}
+	recordType := header[4]
+	keyLength := int64(binary.BigEndian.Uint16(header[5:]))
+	length := int64(binary.BigEndian.Uint64(header[7:]))
+	copy(checksum[:], header[15:])
+	if recordType != recordBlock && recordType != recordRemoved {
+		return 0, "", 0, checksum, errors.New("bad record type")
+	}
+	if offset+recordHeaderSize+keyLength+length > end {
+		return 0, "", 0, checksum, io.ErrUnexpectedEOF
+	}
+	key := make([]byte, keyLength)
+	if _, err := file.ReadAt(key, offset+recordHeaderSize); err != nil {
+		return 0, "", 0, checksum, err
+	}
+	return recordType, string(key), length, checksum, nil
+}
+
+func verifyRecord(file *os.File, offset int64, key string, length int64, checksum [sha256.Size]byte) error {
+	hash := sha256.New()
+	hash.Write([]byte(key))
+	dataOffset := offset + recordHeaderSize + int64(len(key))
+	if _, err := io.Copy(hash, io.NewSectionReader(file, dataOffset, length)); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash.Sum(nil), checksum[:]) {
+		return ChecksumMismatch{Key: key}
+	}
+	return nil
+}
+
+func (sc *segmentCache) segmentPath(id uint64) string {
+	return path.Join(sc.root, fmt.Sprintf("%016x%s", id, segmentSuffix))
+}
+
+// active returns the segment being appended to.
+func (sc *segmentCache) active() *segment {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	return sc.segments[len(sc.segments)-1]
+}
+
+// rotate seals the active segment and starts a new one. The writeLock
+// must be held.
+func (sc *segmentCache) rotate() error {
+	id := uint64(0)
+	sc.lock.Lock()
+	count := len(sc.segments)
+	sc.lock.Unlock()
+	if count > 0 {
+		sealed := sc.active()
+		// records copied by evict are synced when sealed
+		if err := sealed.file.Sync(); err != nil {
+			return err
+		}
+		id = sealed.id + 1
+	}
+	file, err := os.OpenFile(sc.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(sc.root); err != nil {
+		log.Println("Unable to sync", sc.root, err)
+	}
+	sc.lock.Lock()
+	sc.segments = append(sc.segments, &segment{id: id, file: file, keys: make(map[string]bool)})
+	sc.lock.Unlock()
+	return nil
+}
+
+// appendRecord writes a record to the active segment, and syncs it if sync
+// is set. The writeLock must be held, the lock must not.
+func (sc *segmentCache) appendRecord(recordType byte, key string, data []byte, checksum [sha256.Size]byte, sync bool) (*location, error) {
+	if len(key) > 0xffff {
+		return nil, errors.New("key too long: " + key)
+	}
+	active := sc.active()
+	if active.size > 0 && active.size+recordHeaderSize+int64(len(key)+len(data)) > sc.segmentSize {
+		if err := sc.rotate(); err != nil {
+			return nil, err
+		}
+		active = sc.active()
+	}
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(key)+len(data))
+	binary.BigEndian.PutUint32(record, recordMagic)
+	record[4] = recordType
+	binary.BigEndian.PutUint16(record[5:], uint16(len(key)))
+	binary.BigEndian.PutUint64(record[7:], uint64(len(data)))
+	copy(record[15:], checksum[:])
+	record = append(record, key...)
+	record = append(record, data...)
+	if _, err := active.file.WriteAt(record, active.size); err != nil {
+		active.file.Truncate(active.size)
+		return nil, err
+	}
+	if sync {
+		if err := active.file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	loc := &location{
+		segment:  active,
+		offset:   active.size + recordHeaderSize + int64(len(key)),
+		length:   int64(len(data)),
+		checksum: checksum,
+	}
+	sc.lock.Lock()
+	active.size += int64(len(record))
+	sc.size += int64(len(record))
+	diskCacheSize.WithLabelValues(sc.root).Set(float64(sc.size))
+	sc.lock.Unlock()
+	return loc, nil
+}
+
+func recordChecksum(key string, data []byte) [sha256.Size]byte {
+	hash := sha256.New()
+	hash.Write([]byte(key))
+	hash.Write(data)
+	var checksum [sha256.Size]byte
+	copy(checksum[:], hash.Sum(nil))
+	return checksum
+}
+
+func (sc *segmentCache) Put(key string, reader io.Reader) error {
+	defer observeDuration("put", time.Now())
+	// read before locking, the reader may be an upstream response
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	checksum := recordChecksum(key, data)
+
+	sc.writeLock.Lock()
+	if sc.contains(key) {
+		sc.writeLock.Unlock()
+		return &os.PathError{Op: "put", Path: key, Err: os.ErrExist}
+	}
+	loc, err := sc.appendRecord(recordBlock, key, data, checksum, true)
+	if err != nil {
+		sc.writeLock.Unlock()
+		return err
+	}
+	sc.lock.Lock()
+	sc.index[key] = loc
+	loc.segment.keys[key] = true
+	size := sc.size
+	sc.lock.Unlock()
+	sc.writeLock.Unlock()
+
+	// writes only wait for eviction past maxSize
+	if size > sc.maxSize {
+		sc.evict()
+	} else if size > sc.cleanedSize {
+		select {
+		case sc.clean <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (sc *segmentCache) contains(key string) bool {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	_, ok := sc.index[key]
+	return ok
+}
+
+// acquire returns the location of a key and pins its segment until release.
+func (sc *segmentCache) acquire(key string) (*location, error) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	loc, ok := sc.index[key]
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	loc.hit = true
+	loc.segment.refs++
+	return loc, nil
+}
+
+func (sc *segmentCache) release(seg *segment) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	seg.refs--
+	if seg.evicted && seg.refs == 0 {
+		seg.file.Close()
+	}
+}
+
+// Get reads a whole block and verifies it against its checksum.
+func (sc *segmentCache) Get(key string) (io.ReadCloser, error) {
+	defer observeDuration("get", time.Now())
+	loc, err := sc.acquire(key)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, loc.length)
+	_, err = loc.segment.file.ReadAt(data, loc.offset)
+	sc.release(loc.segment)
+	if err != nil {
+		return nil, err
+	}
+	if recordChecksum(key, data) != loc.checksum {
+		log.Println("Checksum mismatch, removing", key)
+		diskCacheChecksumMismatches.Inc()
+		sc.Remove(key)
+		return nil, ChecksumMismatch{Key: key}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (sc *segmentCache) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	loc, err := sc.acquire(key)
+	if err != nil {
+		return nil, err
+	}
+	if offset+length > loc.length {
+		length = loc.length - offset
+	}
+	return &segmentReader{
+		Reader:  io.NewSectionReader(loc.segment.file, loc.offset+offset, length),
+		cache:   sc,
+		segment: loc.segment,
+	}, nil
+}
+
+// segmentReader keeps its segment open until it is closed.
+type segmentReader struct {
+	io.Reader
+	cache   *segmentCache
+	segment *segment
+	once    sync.Once
+}
+
+func (r *segmentReader) Close() error {
+	r.once.Do(func() { r.cache.release(r.segment) })
+	return nil
+}
+
+// Admit always stores blocks, segments are evicted in the order they were
+// written.
+func (sc *segmentCache) Admit(key string, size int64) bool {
+	return true
+}
+
+func (sc *segmentCache) Expires(key string, expires time.Time) {}
+
+// GetFile is not supported, blocks do not have their own file.
+func (sc *segmentCache) GetFile(key string) (*os.File, error) {
+	return nil, errors.New("segment store has no file per block")
+}
+
+func (sc *segmentCache) Hit(key string) error {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	if loc, ok := sc.index[key]; ok {
+		loc.hit = true
+	}
+	return nil
+}
+
+func (sc *segmentCache) Remove(key string) {
+	sc.writeLock.Lock()
+	defer sc.writeLock.Unlock()
+	if !sc.contains(key) {
+		return
+	}
+	if _, err := sc.appendRecord(recordRemoved, key, nil, recordChecksum(key, nil), true); err != nil {
+		log.Println("Unable to remove", key, err)
+		return
+	}
+	sc.lock.Lock()
+	if loc, ok := sc.index[key]; ok {
+		delete(loc.segment.keys, key)
+		delete(sc.index, key)
+	}
+	sc.lock.Unlock()
+}
+
+// liveBlock is a block of a segment being evicted that is copied forward.
+type liveBlock struct {
+	key string
+	loc *location
+}
+
+// evict evicts the oldest segments until the store is under cleanedSize.
+// Blocks are copied without holding the lock, and synced once before the
+// segment they are copied from is removed.
+func (sc *segmentCache) evict() {
+	sc.cleanLock.Lock()
+	defer sc.cleanLock.Unlock()
+	for {
+		sc.lock.Lock()
+		if sc.size <= sc.cleanedSize || len(sc.segments) <= 1 {
+			sc.lock.Unlock()
+			return
+		}
+		oldest := sc.segments[0]
+		var live []liveBlock
+		for key := range oldest.keys {
+			if loc := sc.index[key]; loc.hit {
+				live = append(live, liveBlock{key: key, loc: loc})
+			}
+		}
+		sc.lock.Unlock()
+
+		sort.Slice(live, func(i, j int) bool { return live[i].key < live[j].key })
+		// copy at most half the segment, so each eviction frees space
+		budget := oldest.size / 2
+		for _, block := range live {
+			if budget < block.loc.length {
+				continue
+			}
+			budget -= block.loc.length
+			if err := sc.copyForward(oldest, block); err != nil {
+				log.Println("Unable to compact", block.key, err)
+				break
+			}
+		}
+		sc.writeLock.Lock()
+		err := sc.active().file.Sync()
+		sc.writeLock.Unlock()
+		if err != nil {
+			// the segment is kept until its blocks are safely copied
+			log.Println("Unable to compact", oldest.file.Name(), err)
+			return
+		}
+
+		sc.lock.Lock()
+		for key := range oldest.keys {
+			delete(sc.index, key)
+			diskCacheEvictions.Inc()
+		}
+		sc.segments = sc.segments[1:]
+		sc.size -= oldest.size
+		diskCacheSize.WithLabelValues(sc.root).Set(float64(sc.size))
+		oldest.evicted = true
+		if oldest.refs == 0 {
+			oldest.file.Close()
+		}
+		sc.lock.Unlock()
+		if err := os.Remove(oldest.file.Name()); err != nil {
+			log.Println("Unable to remove segment", oldest.file.Name(), err)
+		}
+	}
+}
+
+// copyForward appends a block of a segment being evicted to the active
+// segment, unless it was removed or replaced meanwhile. Corrupt blocks are
+// dropped.
+func (sc *segmentCache) copyForward(oldest *segment, block liveBlock) error {
+	data := make([]byte, block.loc.length)
+	if _, err := oldest.file.ReadAt(data, block.loc.offset); err != nil {
+		return err
+	}
+	if recordChecksum(block.key, data) != block.loc.checksum {
+		diskCacheChecksumMismatches.Inc()
+		return nil
+	}
+	sc.writeLock.Lock()
+	defer sc.writeLock.Unlock()
+	sc.lock.Lock()
+	current := sc.index[block.key]
+	sc.lock.Unlock()
+	if current != block.loc {
+		return nil
+	}
+	moved, err := sc.appendRecord(recordBlock, block.key, data, block.loc.checksum, false)
+	if err != nil {
+		return err
+	}
+	sc.lock.Lock()
+	delete(oldest.keys, block.key)
+	sc.index[block.key] = moved
+	moved.segment.keys[block.key] = true
+	sc.lock.Unlock()
+	return nil
+}
+
+func (sc *segmentCache) Shutdown() error {
+	sc.shutdown.Do(func() { close(sc.done) })
+	sc.cleanLock.Lock()
+	defer sc.cleanLock.Unlock()
+	sc.writeLock.Lock()
+	defer sc.writeLock.Unlock()
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	var err error
+	for _, seg := range sc.segments {
+		if closeErr := seg.file.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
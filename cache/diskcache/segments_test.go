@@ -0,0 +1,184 @@
+package diskcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readBlock(t *testing.T, cache Cache, key string) string {
+	reader, err := cache.Get(key)
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func TestSegmentsPutGetReplay(t *testing.T) {
+	root, err := ioutil.TempDir("", "segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cache, err := NewSegments(root, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, cache.Put("block-0", bytes.NewReader([]byte("hello"))))
+	assert.True(t, os.IsExist(cache.Put("block-0", bytes.NewReader([]byte("again")))))
+	assert.Nil(t, cache.Put("block-1", bytes.NewReader([]byte("world"))))
+	cache.Remove("block-1")
+	assert.Equal(t, "hello", readBlock(t, cache, "block-0"))
+	assert.Equal(t, "", readBlock(t, cache, "block-1"))
+
+	reader, err := cache.GetRange("block-0", 1, 3)
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "ell", string(data))
+	cache.Shutdown()
+
+	// A crash mid-append leaves a partial record at the end.
+	segment := path.Join(root, "0000000000000000"+segmentSuffix)
+	info, _ := os.Stat(segment)
+	file, _ := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0600)
+	file.Write([]byte("partial"))
+	file.Close()
+
+	cache, err = NewSegments(root, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Shutdown()
+	assert.Equal(t, "hello", readBlock(t, cache, "block-0"))
+	assert.Equal(t, "", readBlock(t, cache, "block-1"))
+	truncated, _ := os.Stat(segment)
+	assert.Equal(t, info.Size(), truncated.Size())
+}
+
+func TestSegmentsEviction(t *testing.T) {
+	root, err := ioutil.TempDir("", "segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// segments of 1M, blocks of 100k
+	cache, err := NewSegments(root, 8<<20, 8<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Shutdown()
+	sc := cache.(*segmentCache)
+
+	block := bytes.Repeat([]byte("x"), 100<<10)
+	assert.Nil(t, cache.Put("hot", bytes.NewReader(block)))
+	assert.Nil(t, cache.Put("cold", bytes.NewReader(block)))
+	for i := 0; i < 100; i++ {
+		cache.Hit("hot")
+		assert.Nil(t, cache.Put("block-"+strconv.Itoa(i), bytes.NewReader(block)))
+	}
+
+	assert.True(t, sc.size <= 8<<20)
+	assert.Equal(t, string(block), readBlock(t, cache, "hot"), "hit blocks are compacted")
+	assert.Equal(t, "", readBlock(t, cache, "cold"))
+	assert.Equal(t, string(block), readBlock(t, cache, "block-99"))
+	files, _ := ioutil.ReadDir(root)
+	assert.Equal(t, len(sc.segments), len(files))
+}
+
+func TestSegmentsBackgroundEviction(t *testing.T) {
+	root, err := ioutil.TempDir("", "segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// writes never wait for eviction under 64M
+	cache, err := NewSegments(root, 64<<20, 2<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Shutdown()
+	sc := cache.(*segmentCache)
+
+	block := bytes.Repeat([]byte("x"), 100<<10)
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, cache.Put("block-"+strconv.Itoa(i), bytes.NewReader(block)))
+	}
+	size := func() int64 {
+		sc.lock.Lock()
+		defer sc.lock.Unlock()
+		return sc.size
+	}
+	for i := 0; i < 100 && size() > 2<<20; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, size() <= 2<<20)
+	assert.Equal(t, string(block), readBlock(t, cache, "block-49"))
+}
+
+func TestSegmentsMinimumSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// an eighth of 64 bytes would seal a segment per record
+	cache, err := NewSegments(root, 64, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Shutdown()
+	sc := cache.(*segmentCache)
+	assert.Equal(t, int64(minSegmentSize), sc.segmentSize)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, cache.Put("block-"+strconv.Itoa(i), bytes.NewReader([]byte("data"))))
+	}
+	assert.Equal(t, 1, len(sc.segments))
+	assert.Equal(t, "data", readBlock(t, cache, "block-9"))
+}
+
+func benchmarkStore(b *testing.B, store Store) {
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cache, err := store(root, 64<<20, 48<<20)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cache.Shutdown()
+	block := bytes.Repeat([]byte("x"), 2<<20)
+	b.SetBytes(int64(len(block)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := "block-" + strconv.Itoa(i)
+		if err := cache.Put(key, bytes.NewReader(block)); err != nil {
+			b.Fatal(err)
+		}
+		reader, err := cache.Get(key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		reader.Close()
+	}
+}
+
+func BenchmarkFiles(b *testing.B) {
+	benchmarkStore(b, New)
+}
+
+func BenchmarkSegments(b *testing.B) {
+	benchmarkStore(b, NewSegments)
+}
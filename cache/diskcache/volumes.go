@@ -0,0 +1,189 @@
+package diskcache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Volume is a disk cache root with its own capacity.
+type Volume struct {
+	Root        string
+	MaxSize     int64
+	CleanedSize int64
+}
+
+type volume struct {
+	Volume
+	cache  Cache
+	failed bool
+}
+
+// volumes spreads blocks over several roots, e.g. one per disk. Blocks are
+// placed by weighted rendezvous hashing, so roots hold blocks in proportion
+// to their capacity and a failed root only moves its own blocks. A root
+// that fails is taken out of rotation and its blocks become misses.
+type volumes struct {
+	lock    sync.RWMutex
+	volumes []*volume
+}
+
+// Store opens a disk cache in a root, e.g. New or NewSegments.
+type Store func(root string, maxSize int64, cleanedSize int64) (Cache, error)
+
+// NewVolumes opens a disk cache on every root. Roots that cannot be opened
+// are left out, it fails only if none can be.
+func NewVolumes(roots []Volume, store Store) (Cache, error) {
+	v := &volumes{}
+	for _, root := range roots {
+		cache, err := store(root.Root, root.MaxSize, root.CleanedSize)
+		if err != nil {
+			log.Println("Unable to open disk cache", root.Root, err)
+			diskCacheVolumeUp.WithLabelValues(root.Root).Set(0)
+			continue
+		}
+		diskCacheVolumeUp.WithLabelValues(root.Root).Set(1)
+		v.volumes = append(v.volumes, &volume{Volume: root, cache: cache})
+	}
+	if len(v.volumes) == 0 {
+		return nil, errors.New("no usable disk cache roots")
+	}
+	return v, nil
+}
+
+// pick returns the volume of a key among the volumes in rotation.
+func (v *volumes) pick(key string) *volume {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	var best *volume
+	bestScore := math.Inf(-1)
+	for _, vol := range v.volumes {
+		if vol.failed {
+			continue
+		}
+		sum := sha256.Sum256([]byte(vol.Root + "\x00" + key))
+		// uniform in (0, 1)
+		u := (float64(binary.BigEndian.Uint64(sum[:])>>11) + 0.5) / (1 << 53)
+		score := float64(vol.MaxSize) / -math.Log(u)
+		if score > bestScore {
+			best, bestScore = vol, score
+		}
+	}
+	return best
+}
+
+// check takes a volume out of rotation if err means its disk failed.
+func (v *volumes) check(vol *volume, err error) error {
+	if err == nil || !isVolumeFailure(err) {
+		return err
+	}
+	v.lock.Lock()
+	if !vol.failed {
+		log.Println("Disk cache root failed, taking it out of rotation", vol.Root, err)
+		vol.failed = true
+		diskCacheVolumeUp.WithLabelValues(vol.Root).Set(0)
+	}
+	v.lock.Unlock()
+	return err
+}
+
+func isVolumeFailure(err error) bool {
+	switch typedErr := err.(type) {
+	case *os.PathError:
+		err = typedErr.Err
+	case *os.LinkError:
+		err = typedErr.Err
+	case *os.SyscallError:
+		err = typedErr.Err
+	}
+	switch err {
+	case syscall.EIO, syscall.EROFS, syscall.ENODEV, syscall.ENXIO:
+		return true
+	}
+	return false
+}
+
+var errNoVolume = errors.New("no disk cache root in rotation")
+
+func (v *volumes) Get(key string) (io.ReadCloser, error) {
+	vol := v.pick(key)
+	if vol == nil {
+		return nil, errNoVolume
+	}
+	reader, err := vol.cache.Get(key)
+	return reader, v.check(vol, err)
+}
+
+func (v *volumes) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	vol := v.pick(key)
+	if vol == nil {
+		return nil, errNoVolume
+	}
+	reader, err := vol.cache.GetRange(key, offset, length)
+	return reader, v.check(vol, err)
+}
+
+func (v *volumes) GetFile(key string) (*os.File, error) {
+	vol := v.pick(key)
+	if vol == nil {
+		return nil, errNoVolume
+	}
+	file, err := vol.cache.GetFile(key)
+	return file, v.check(vol, err)
+}
+
+func (v *volumes) Hit(key string) error {
+	vol := v.pick(key)
+	if vol == nil {
+		return errNoVolume
+	}
+	return v.check(vol, vol.cache.Hit(key))
+}
+
+func (v *volumes) Admit(key string, size int64) bool {
+	vol := v.pick(key)
+	return vol != nil && vol.cache.Admit(key, size)
+}
+
+func (v *volumes) Expires(key string, expires time.Time) {
+	if vol := v.pick(key); vol != nil {
+		vol.cache.Expires(key, expires)
+	}
+}
+
+func (v *volumes) Put(key string, reader io.Reader) error {
+	vol := v.pick(key)
+	if vol == nil {
+		return errNoVolume
+	}
+	return v.check(vol, vol.cache.Put(key, reader))
+}
+
+// Remove removes a key from every root in rotation, as it may have been
+// placed before another root failed.
+func (v *volumes) Remove(key string) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	for _, vol := range v.volumes {
+		if !vol.failed {
+			vol.cache.Remove(key)
+		}
+	}
+}
+
+func (v *volumes) Shutdown() error {
+	var err error
+	for _, vol := range v.volumes {
+		if shutdownErr := vol.cache.Shutdown(); shutdownErr != nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
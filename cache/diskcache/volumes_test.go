@@ -0,0 +1,59 @@
+package diskcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(path.Join(dir, "small"), 0700)
+	os.Mkdir(path.Join(dir, "large"), 0700)
+
+	cache, err := NewVolumes([]Volume{
+		{Root: path.Join(dir, "small"), MaxSize: 1 << 20, CleanedSize: 1 << 20},
+		{Root: path.Join(dir, "large"), MaxSize: 3 << 20, CleanedSize: 3 << 20},
+	}, New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := cache.(*volumes)
+	defer v.Shutdown()
+
+	placed := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		placed[v.pick("block-"+strconv.Itoa(i)).Root]++
+	}
+	assert.InDelta(t, 250, placed[path.Join(dir, "small")], 60)
+
+	assert.Nil(t, v.Put("block-0", bytes.NewReader([]byte("hello"))))
+	reader, err := v.Get("block-0")
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	assert.Equal(t, "hello", string(data))
+
+	// A disk error takes the root out of rotation, its keys move.
+	failed := v.pick("block-0")
+	v.check(failed, &os.PathError{Op: "read", Path: failed.Root, Err: syscall.EIO})
+	assert.True(t, failed.failed)
+	assert.NotEqual(t, failed, v.pick("block-0"))
+	_, err = v.Get("block-0")
+	assert.NotNil(t, err)
+
+	// Other errors do not.
+	healthy := v.pick("block-0")
+	v.check(healthy, os.ErrNotExist)
+	assert.False(t, healthy.failed)
+}
@@ -0,0 +1,115 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/fkautz/casserole/cache/router"
+)
+
+// NewAdminHandler serves the administrative api:
+//
+//	POST /purge?url=http://host/path[&blocks=true]
+//	POST /purge?prefix=http://host/path/prefix[&blocks=true]
+//	POST /purge?regex=<expression>[&blocks=true]
+//
+// url and prefix are matched to a route like client requests, regex is
+// matched against the upstream path of every route. With blocks=true the
+// disk blocks of purged objects are removed from every node.
+func NewAdminHandler(routes *router.Router) http.Handler {
+	return &adminHandler{
+		routes: routes,
+	}
+}
+
+type adminHandler struct {
+	routes *router.Router
+}
+
+type purgeResponse struct {
+	Purged []string `json:"purged"`
+	Error  string   `json:"error,omitempty"`
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/purge" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	blocks := r.Form.Get("blocks") == "true"
+
+	response := purgeResponse{
+		Purged: []string{},
+	}
+	var err error
+	switch {
+	case r.Form.Get("url") != "":
+		err = a.purgeMatching(r.Form.Get("url"), blocks, &response, func(request string) hydrator.PurgeMatch {
+			return hydrator.PurgeMatch{Url: request}
+		})
+	case r.Form.Get("prefix") != "":
+		err = a.purgeMatching(r.Form.Get("prefix"), blocks, &response, func(request string) hydrator.PurgeMatch {
+			return hydrator.PurgeMatch{Prefix: request}
+		})
+	case r.Form.Get("regex") != "":
+		match := hydrator.PurgeMatch{Regex: r.Form.Get("regex")}
+		if _, compileErr := match.Matcher(); compileErr != nil {
+			http.Error(w, compileErr.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, route := range a.routes.Routes() {
+			purgeErr := a.purge(route, blocks, &response, match)
+			if purgeErr != nil {
+				err = purgeErr
+			}
+		}
+	default:
+		http.Error(w, "one of url, prefix or regex is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, ok := err.(router.NoRoute); ok {
+		w.WriteHeader(http.StatusNotFound)
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// purgeMatching purges the route serving rawUrl, with the match built from
+// the request path relative to the route.
+func (a *adminHandler) purgeMatching(rawUrl string, blocks bool, response *purgeResponse, match func(request string) hydrator.PurgeMatch) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	route, request, err := a.routes.Match(u.Host, u.Path)
+	if err != nil {
+		return err
+	}
+	return a.purge(route, blocks, response, match(request))
+}
+
+func (a *adminHandler) purge(route *router.Route, blocks bool, response *purgeResponse, match hydrator.PurgeMatch) error {
+	purged, err := route.Cache.Purge(match, blocks)
+	for _, url := range purged {
+		log.Println("Purged", route.Upstream+"/"+url)
+		response.Purged = append(response.Purged, route.Upstream+"/"+url)
+	}
+	return err
+}
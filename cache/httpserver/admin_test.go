@@ -0,0 +1,88 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/fkautz/casserole/cache/router"
+	"github.com/fkautz/casserole/cache/sizereaderat"
+	"github.com/stretchr/testify/assert"
+)
+
+type purgeCache struct {
+	urls   []string
+	blocks bool
+}
+
+func (c *purgeCache) Get(url string, cacheEntry *hydrator.CacheEntry, trace *hydrator.Trace) (sizereaderat.SizeReaderAt, error) {
+	return nil, nil
+}
+
+func (c *purgeCache) GetMetadata(url string, clientHeaders http.Header, trace *hydrator.Trace) (*hydrator.CacheEntry, error) {
+	return nil, nil
+}
+
+func (c *purgeCache) Forward(url string, request *http.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+func (c *purgeCache) Purge(purgeMatch hydrator.PurgeMatch, blocks bool) ([]string, error) {
+	c.blocks = blocks
+	match, err := purgeMatch.Matcher()
+	if err != nil {
+		return nil, err
+	}
+	var purged []string
+	for _, url := range c.urls {
+		if match(url) {
+			purged = append(purged, url)
+		}
+	}
+	return purged, nil
+}
+
+func adminPurge(form url.Values) (*purgeCache, purgeResponse, int) {
+	cache := &purgeCache{
+		urls: []string{"org/a.jar", "org/b.jar", "com/c.jar"},
+	}
+	route, _ := router.ParseRoute("/maven=http://maven")
+	route.Cache = cache
+	handler := NewAdminHandler(router.NewRouter(route))
+
+	request := httptest.NewRequest("POST", "/purge", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	response := purgeResponse{}
+	json.NewDecoder(recorder.Body).Decode(&response)
+	return cache, response, recorder.Code
+}
+
+func TestAdminPurgeUrl(t *testing.T) {
+	cache, response, code := adminPurge(url.Values{"url": {"http://cache/maven/org/a.jar"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"http://maven/org/a.jar"}, response.Purged)
+	assert.False(t, cache.blocks)
+}
+
+func TestAdminPurgePrefix(t *testing.T) {
+	cache, response, code := adminPurge(url.Values{"prefix": {"/maven/org/"}, "blocks": {"true"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"http://maven/org/a.jar", "http://maven/org/b.jar"}, response.Purged)
+	assert.True(t, cache.blocks)
+}
+
+func TestAdminPurgeRegex(t *testing.T) {
+	_, response, code := adminPurge(url.Values{"regex": {"^com/"}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"http://maven/com/c.jar"}, response.Purged)
+
+	_, _, code = adminPurge(url.Values{"url": {"http://cache/debian/foo.deb"}})
+	assert.Equal(t, http.StatusNotFound, code)
+}
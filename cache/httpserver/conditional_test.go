@@ -0,0 +1,62 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testModtime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func checkRequest(headers map[string]string) (*httptest.ResponseRecorder, bool, string) {
+	request := httptest.NewRequest("GET", "/foo", nil)
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	response := httptest.NewRecorder()
+	response.Header().Set("Etag", `"v1"`)
+	response.Header().Set("Content-Length", "16")
+	done, rangeHeader := checkPreconditions(response, request, `"v1"`, testModtime)
+	return response, done, rangeHeader
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	response, done, _ := checkRequest(map[string]string{"If-None-Match": `"v0", W/"v1"`})
+	assert.True(t, done)
+	assert.Equal(t, http.StatusNotModified, response.Code)
+	assert.Equal(t, "", response.Header().Get("Content-Length"))
+
+	_, done, _ = checkRequest(map[string]string{"If-None-Match": `"v2"`})
+	assert.False(t, done)
+}
+
+func TestIfModifiedSince(t *testing.T) {
+	response, done, _ := checkRequest(map[string]string{"If-Modified-Since": testModtime.Format(http.TimeFormat)})
+	assert.True(t, done)
+	assert.Equal(t, http.StatusNotModified, response.Code)
+
+	_, done, _ = checkRequest(map[string]string{"If-Modified-Since": testModtime.Add(-time.Hour).Format(http.TimeFormat)})
+	assert.False(t, done)
+}
+
+func TestIfMatch(t *testing.T) {
+	response, done, _ := checkRequest(map[string]string{"If-Match": `"v2"`})
+	assert.True(t, done)
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code)
+}
+
+func TestIfRange(t *testing.T) {
+	_, done, rangeHeader := checkRequest(map[string]string{"Range": "bytes=1-2", "If-Range": `"v1"`})
+	assert.False(t, done)
+	assert.Equal(t, "bytes=1-2", rangeHeader)
+
+	_, done, rangeHeader = checkRequest(map[string]string{"Range": "bytes=1-2", "If-Range": `"v2"`})
+	assert.False(t, done)
+	assert.Equal(t, "", rangeHeader)
+
+	_, _, rangeHeader = checkRequest(map[string]string{"Range": "bytes=1-2", "If-Range": testModtime.Format(http.TimeFormat)})
+	assert.Equal(t, "bytes=1-2", rangeHeader)
+}
@@ -0,0 +1,190 @@
+package httpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/fkautz/casserole/cache/memorycache"
+	"github.com/fkautz/casserole/cache/sizereaderat"
+)
+
+// serveContent writes reader to w honoring rangeHeader. Single ranges are
+// answered directly and multiple ranges as multipart/byteranges. Only the
+// blocks covering the requested ranges are read.
+func (s *httpHandler) serveContent(w http.ResponseWriter, rangeHeader string, reader sizereaderat.SizeReaderAt) {
+	size := reader.Size()
+	ranges, err := parseRange(rangeHeader, size)
+	if err != nil {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if sumRangesSize(ranges) > size {
+		// The total being bigger than the object is a sign of a broken or
+		// abusive client, so fall back to sending the whole object.
+		ranges = nil
+	}
+	// Trailers are only sent with chunked encoding, which a Content-Length
+	// would prevent.
+	_, chunked := w.Header()["Trailer"]
+
+	switch len(ranges) {
+	case 0:
+		setContentLength(w, chunked, size)
+		w.WriteHeader(http.StatusOK)
+		if err := s.copyRange(w, reader, 0, size); err != nil {
+			log.Println(err)
+		}
+	case 1:
+		ra := ranges[0]
+		setContentLength(w, chunked, ra.length)
+		w.Header().Set("Content-Range", ra.contentRange(size))
+		w.WriteHeader(http.StatusPartialContent)
+		if err := s.copyRange(w, reader, ra.start, ra.length); err != nil {
+			log.Println(err)
+		}
+	default:
+		contentType := w.Header().Get("Content-Type")
+		mw := multipart.NewWriter(w)
+		setContentLength(w, chunked, rangesMIMESize(ranges, contentType, size, mw.Boundary()))
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.WriteHeader(http.StatusPartialContent)
+		for _, ra := range ranges {
+			part, err := mw.CreatePart(ra.mimeHeader(contentType, size))
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if err := s.copyRange(part, reader, ra.start, ra.length); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+		mw.Close()
+	}
+}
+
+func setContentLength(w http.ResponseWriter, chunked bool, length int64) {
+	if chunked {
+		w.Header().Del("Content-Length")
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+}
+
+// copyRange streams length bytes from start one block at a time.
+func (s *httpHandler) copyRange(w io.Writer, reader io.ReaderAt, start, length int64) error {
+	_, err := io.Copy(w, gcache.NewLazyReader(reader, start, start+length, s.blockSize))
+	return err
+}
+
+// from "net/http".httpRange
+type httpRange struct {
+	start, length int64
+}
+
+// from "net/http".parseRange
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil // header not present
+	}
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("invalid range")
+	}
+	var ranges []httpRange
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, errors.New("invalid range")
+		}
+		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+		var r httpRange
+		if start == "" {
+			// If no start is specified, end specifies the
+			// range start relative to the end of the file.
+			i, err := strconv.ParseInt(end, 10, 64)
+			if err != nil {
+				return nil, errors.New("invalid range")
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i >= size || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			r.start = i
+			if end == "" {
+				// If no end is specified, range extends to end of the file.
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errors.New("invalid range")
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+func sumRangesSize(ranges []httpRange) (size int64) {
+	for _, ra := range ranges {
+		size += ra.length
+	}
+	return
+}
+
+// from "net/http".rangesMIMESize
+func rangesMIMESize(ranges []httpRange, contentType string, contentSize int64, boundary string) (encSize int64) {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	for _, ra := range ranges {
+		mw.CreatePart(ra.mimeHeader(contentType, contentSize))
+		encSize += ra.length
+	}
+	mw.Close()
+	encSize += int64(w)
+	return
+}
+
+// from "net/http".countingWriter
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,69 @@
+package httpserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serveRange(rangeHeader string) *httptest.ResponseRecorder {
+	handler := &httpHandler{blockSize: 4}
+	response := httptest.NewRecorder()
+	response.Header().Set("Content-Type", "text/plain")
+	handler.serveContent(response, rangeHeader, bytes.NewReader([]byte("0123456789abcdef")))
+	return response
+}
+
+func TestServeContentFull(t *testing.T) {
+	response := serveRange("")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "0123456789abcdef", response.Body.String())
+}
+
+func TestServeContentSingleRange(t *testing.T) {
+	response := serveRange("bytes=3-9")
+	assert.Equal(t, http.StatusPartialContent, response.Code)
+	assert.Equal(t, "bytes 3-9/16", response.Header().Get("Content-Range"))
+	assert.Equal(t, "7", response.Header().Get("Content-Length"))
+	assert.Equal(t, "3456789", response.Body.String())
+}
+
+func TestServeContentMultipleRanges(t *testing.T) {
+	response := serveRange("bytes=0-1, 6-10,-2")
+	assert.Equal(t, http.StatusPartialContent, response.Code)
+	assert.Equal(t, strconv.Itoa(response.Body.Len()), response.Header().Get("Content-Length"))
+
+	mediaType, params, err := mime.ParseMediaType(response.Header().Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	reader := multipart.NewReader(response.Body, params["boundary"])
+	expected := []struct{ contentRange, body string }{
+		{"bytes 0-1/16", "01"},
+		{"bytes 6-10/16", "6789a"},
+		{"bytes 14-15/16", "ef"},
+	}
+	for _, e := range expected {
+		part, err := reader.NextPart()
+		assert.Nil(t, err)
+		assert.Equal(t, e.contentRange, part.Header.Get("Content-Range"))
+		assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(part)
+		assert.Equal(t, e.body, string(body))
+	}
+	_, err = reader.NextPart()
+	assert.NotNil(t, err)
+}
+
+func TestServeContentUnsatisfiable(t *testing.T) {
+	response := serveRange("bytes=20-30")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, response.Code)
+	assert.Equal(t, "bytes */16", response.Header().Get("Content-Range"))
+}
@@ -1,37 +1,43 @@
 package httpserver
 
 import (
-	"errors"
 	"github.com/fkautz/casserole/cache/hydrator"
-	"github.com/fkautz/casserole/cache/memorycache"
+	"github.com/fkautz/casserole/cache/router"
 	"github.com/fkautz/casserole/cmd"
 	"github.com/gorilla/mux"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func NewHttpHandler(config cmd.Config, cache hydrator.Cache, blockSize int64) http.Handler {
+func NewHttpHandler(config cmd.Config, routes *router.Router, blockSize int64) http.Handler {
 	return &httpHandler{
-		cache:     cache,
+		routes:    routes,
 		blockSize: blockSize,
-		config: config,
+		config:    config,
 	}
 }
 
 type httpHandler struct {
-	cache     hydrator.Cache
+	routes    *router.Router
 	blockSize int64
-	config cmd.Config
+	config    cmd.Config
 }
 
 func (s *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// get request url
 	vars := mux.Vars(r)
-	request := vars["request"]
+	route, request, err := s.routes.Match(r.Host, vars["request"])
+	if err != nil {
+		log.Println("No route for", r.Host, vars["request"])
+		http.Error(w, "No upstream configured for host "+r.Host, http.StatusMisdirectedRequest)
+		return
+	}
+	cache := route.Cache
 
 	//if r.Method == "HEAD" {
 	//	w.WriteHeader(200)
@@ -39,28 +45,31 @@ func (s *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//}
 
 	w.Header().Add("X-Cache-Server", "casserole/0.0.1")
+	w.Header().Set("Via", via)
 
 	// if not cacheable
 
+	// only GET and HEAD are served from cache
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Cache-Status", cacheName+"; fwd=uri-miss; detail=method")
+		s.forward(w, r, cache, request)
+		return
+	}
+
 	// get object
-	cacheEntry, err := s.cache.GetMetadata(request, r.Header)
-	canonicalRequest := s.config.MirrorUrl + "/" + request
+	trace := hydrator.NewTrace()
+	cacheEntry, err := cache.GetMetadata(request, r.Header, trace)
 	if err != nil {
-		if err.Error() == "Not Cacheable" || err.Error() == "Chunked" {
+		if _, ok := err.(hydrator.UnexpectedStatus); ok || err.Error() == "Not Cacheable" || err.Error() == "Chunked" {
 			log.Println("MISS", request)
-			resp, err := s.cache.ForceGet(canonicalRequest)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(404)
-				return
-			}
-			io.Copy(w, resp.Body)
-			resp.Body.Close()
-			return
-		} else {
-			w.WriteHeader(404)
+			w.Header().Set("Cache-Status", cacheName+"; fwd=uri-miss; detail=not-cacheable")
+			s.forward(w, r, cache, request)
 			return
 		}
+		log.Println(err)
+		w.Header().Set("Cache-Status", cacheName+"; fwd=miss; fwd-status=502")
+		writeUpstreamError(w, err)
+		return
 	}
 
 	// write object metadata
@@ -69,6 +78,10 @@ func (s *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for k, v := range cacheEntry.Metadata {
 		w.Header().Add(k, v)
 	}
+	w.Header().Set("Cache-Status", cacheStatus(trace, cacheEntry))
+	if retrieved, err := http.ParseTime(cacheEntry.Metadata["X-Cache-Date-Retrieved"]); err == nil {
+		w.Header().Set("Age", age(retrieved))
+	}
 
 	cacheCopy := make(map[string]string)
 
@@ -86,106 +99,139 @@ func (s *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	cacheEntry.Metadata = cacheCopy
 
+	// answer conditional requests from metadata alone
+	lastModified, _ := http.ParseTime(w.Header().Get("Last-Modified"))
+	done, rangeHeader := checkPreconditions(w, r, w.Header().Get("Etag"), lastModified)
+	if done {
+		return
+	}
+
 	// if head, get metadata
 	if r.Method == "HEAD" {
 		w.WriteHeader(200)
 		return
 	}
 
-	reader, err := s.cache.Get(request, cacheEntry)
-	if reader == nil {
+	reader, err := cache.Get(request, cacheEntry, trace)
+	if err != nil {
+		log.Println(err)
+		w.Header().Del("Content-Length")
+		writeUpstreamError(w, err)
 		return
 	}
 
-	if w.Header().Get("Content-Length") == "" {
-		if reader != nil {
-			w.Header().Add("Content-Length", strconv.FormatInt(reader.Size(), 10))
-		}
+	// The tiers serving each block are only known once the body is written,
+	// so the Cache-Status, which depends on them, is sent as a trailer, and
+	// so is the blocksTrailer when asked for.
+	w.Header().Del("Cache-Status")
+	w.Header().Set("Trailer", "Cache-Status")
+	debug := r.Header.Get(debugHeader) != ""
+	if debug {
+		w.Header().Add("Trailer", blocksTrailer)
 	}
+	s.serveContent(w, rangeHeader, reader)
+	w.Header().Set("Cache-Status", cacheStatus(trace, cacheEntry))
+	if debug {
+		w.Header().Set(blocksTrailer, trace.Blocks())
+	}
+}
 
-	// server
-	//http.ServeContent(w, r, request, time.Now(), io.NewSectionReader(reader, 0, reader.Size()))
+const (
+	cacheName = "casserole"
+	via       = "1.1 " + cacheName
 
-	// original
-	ranges, err := parseRange(r.Header.Get("Range"), reader.Size())
+	// debugHeader asks for the blocksTrailer listing which tier served each
+	// block, e.g. "0=memory, 1=peer, 2=disk, 3=origin".
+	debugHeader   = "X-Casserole-Debug"
+	blocksTrailer = "X-Cache-Blocks"
+)
+
+// cacheStatus formats an RFC 9211 Cache-Status value from the outcome of the
+// metadata lookup and the tiers of the blocks read. A response with blocks
+// from the origin is forwarded, in part or in full, even if its metadata
+// was cached.
+func cacheStatus(trace *hydrator.Trace, cacheEntry *hydrator.CacheEntry) string {
+	status := cacheName
+	origin, total := trace.OriginBlocks()
+	switch outcome := trace.Metadata(); {
+	case origin > 0 && origin == total:
+		status += "; fwd=miss; stored"
+	case origin > 0:
+		status += "; fwd=partial; stored"
+	case outcome == hydrator.MetadataHit:
+		status += "; hit"
+	case outcome == hydrator.MetadataStaleWhileRevalidate, outcome == hydrator.MetadataStaleIfError:
+		status += "; hit; detail=" + outcome
+	case outcome == hydrator.MetadataRevalidated:
+		status += "; fwd=stale; stored"
+	default:
+		status += "; fwd=miss; stored"
+	}
+	if cacheEntry.ObjectResults != nil {
+		ttl := time.Until(cacheEntry.ObjectResults.OutExpirationTime) / time.Second
+		status += "; ttl=" + strconv.FormatInt(int64(ttl), 10)
+	}
+	return status
+}
+
+// age is the Age header value of a response retrieved from upstream at
+// retrieved.
+func age(retrieved time.Time) string {
+	seconds := int64(time.Since(retrieved) / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// forward proxies a request that can't be served from cache to upstream and
+// relays the upstream status, headers and body.
+func (s *httpHandler) forward(w http.ResponseWriter, r *http.Request, cache hydrator.Cache, request string) {
+	resp, err := cache.Forward(request, r)
 	if err != nil {
 		log.Println(err)
+		writeUpstreamError(w, err)
+		return
 	}
-	rangeSize := int64(0)
-	for _, ra := range ranges {
-		rangeSize += ra.length
+	defer resp.Body.Close()
+
+	for _, k := range resp.Header["Connection"] {
+		for _, token := range strings.Split(k, ",") {
+			resp.Header.Del(strings.TrimSpace(token))
+		}
 	}
-	if rangeSize > reader.Size() {
-		ranges = nil
+	for _, k := range hopHeaders {
+		resp.Header.Del(k)
 	}
-	streamReader := gcache.NewLazyReader(reader, int64(0), reader.Size(), s.blockSize)
-	if ranges == nil {
-		w.WriteHeader(200)
-		io.Copy(w, streamReader)
+	if upstreamVia := resp.Header.Get("Via"); upstreamVia != "" {
+		resp.Header.Set("Via", upstreamVia+", "+via)
 	} else {
-		http.ServeContent(w, r, request, time.Now(), streamReader)
+		resp.Header.Set("Via", via)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
 	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
 }
 
-// from "net/http".httpRange
-type httpRange struct {
-	start, length int64
+// hopHeaders are meaningful only for a single connection and are not relayed.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
 }
 
-// from "net/http".parseRange
-func parseRange(s string, size int64) ([]httpRange, error) {
-	if s == "" {
-		return nil, nil // header not present
-	}
-	const b = "bytes="
-	if !strings.HasPrefix(s, b) {
-		return nil, errors.New("invalid range")
-	}
-	var ranges []httpRange
-	for _, ra := range strings.Split(s[len(b):], ",") {
-		ra = strings.TrimSpace(ra)
-		if ra == "" {
-			continue
-		}
-		i := strings.Index(ra, "-")
-		if i < 0 {
-			return nil, errors.New("invalid range")
-		}
-		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
-		var r httpRange
-		if start == "" {
-			// If no start is specified, end specifies the
-			// range start relative to the end of the file.
-			i, err := strconv.ParseInt(end, 10, 64)
-			if err != nil {
-				return nil, errors.New("invalid range")
-			}
-			if i > size {
-				i = size
-			}
-			r.start = size - i
-			r.length = size - r.start
-		} else {
-			i, err := strconv.ParseInt(start, 10, 64)
-			if err != nil || i >= size || i < 0 {
-				return nil, errors.New("invalid range")
-			}
-			r.start = i
-			if end == "" {
-				// If no end is specified, range extends to end of the file.
-				r.length = size - r.start
-			} else {
-				i, err := strconv.ParseInt(end, 10, 64)
-				if err != nil || r.start > i {
-					return nil, errors.New("invalid range")
-				}
-				if i >= size {
-					i = size - 1
-				}
-				r.length = i - r.start + 1
-			}
-		}
-		ranges = append(ranges, r)
+// writeUpstreamError answers 504 when upstream timed out and 502 otherwise.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
 	}
-	return ranges, nil
+	w.WriteHeader(http.StatusBadGateway)
 }
@@ -0,0 +1,129 @@
+package httpserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/fkautz/casserole/cache/router"
+	"github.com/fkautz/casserole/cache/sizereaderat"
+	"github.com/fkautz/casserole/cmd"
+	"github.com/gorilla/mux"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStatus(t *testing.T) {
+	cacheEntry := &hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{
+			OutExpirationTime: time.Now().Add(time.Hour),
+		},
+	}
+	trace := hydrator.NewTrace()
+
+	trace.SetMetadata(hydrator.MetadataHit)
+	assert.True(t, strings.HasPrefix(cacheStatus(trace, cacheEntry), "casserole; hit; ttl=35"))
+
+	trace.SetMetadata(hydrator.MetadataMiss)
+	assert.True(t, strings.HasPrefix(cacheStatus(trace, cacheEntry), "casserole; fwd=miss; stored; ttl="))
+
+	trace.SetMetadata(hydrator.MetadataStaleIfError)
+	cacheEntry.ObjectResults.OutExpirationTime = time.Now().Add(-time.Minute)
+	assert.Equal(t, "casserole; hit; detail=stale-if-error; ttl=-60", cacheStatus(trace, cacheEntry))
+
+	// cached metadata, but blocks from the origin
+	trace.SetMetadata(hydrator.MetadataHit)
+	trace.AddBlock(0, hydrator.TierMemory)
+	trace.AddBlock(1, hydrator.TierOrigin)
+	assert.Equal(t, "casserole; fwd=partial; stored; ttl=-60", cacheStatus(trace, cacheEntry))
+	trace = hydrator.NewTrace()
+	trace.SetMetadata(hydrator.MetadataHit)
+	trace.AddBlock(0, hydrator.TierOrigin)
+	assert.Equal(t, "casserole; fwd=miss; stored; ttl=-60", cacheStatus(trace, cacheEntry))
+}
+
+// tierCache serves "01234567" in blocks of 4 bytes from the given tiers
+// with cached metadata.
+type tierCache struct {
+	purgeCache
+	tiers []string
+}
+
+func (c *tierCache) GetMetadata(url string, clientHeaders http.Header, trace *hydrator.Trace) (*hydrator.CacheEntry, error) {
+	trace.SetMetadata(hydrator.MetadataHit)
+	return &hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{OutExpirationTime: time.Now().Add(time.Hour)},
+		Metadata:      map[string]string{"Content-Length": "8"},
+	}, nil
+}
+
+func (c *tierCache) Get(url string, cacheEntry *hydrator.CacheEntry, trace *hydrator.Trace) (sizereaderat.SizeReaderAt, error) {
+	return tierReader{cache: c, trace: trace}, nil
+}
+
+type tierReader struct {
+	cache *tierCache
+	trace *hydrator.Trace
+}
+
+func (r tierReader) Size() int64 {
+	return 8
+}
+
+func (r tierReader) ReadAt(p []byte, off int64) (int, error) {
+	r.trace.AddBlock(off/4, r.cache.tiers[off/4])
+	return strings.NewReader("01234567"[:off/4*4+4]).ReadAt(p, off)
+}
+
+func TestCacheStatusTrailer(t *testing.T) {
+	cache := &tierCache{tiers: []string{hydrator.TierMemory, hydrator.TierOrigin}}
+	route, _ := router.ParseRoute("*=http://upstream")
+	route.Cache = cache
+	handler := mux.NewRouter()
+	handler.Handle("/{request:.*}", NewHttpHandler(cmd.Config{}, router.NewRouter(route), 4))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(method string) *http.Response {
+		request, _ := http.NewRequest(method, server.URL+"/foo", nil)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		if method == "GET" {
+			assert.Equal(t, "01234567", string(body))
+		}
+		return response
+	}
+
+	response := get("GET")
+	assert.Equal(t, "", response.Header.Get("Cache-Status"), "not known before the body")
+	assert.True(t, strings.HasPrefix(response.Trailer.Get("Cache-Status"), "casserole; fwd=partial; stored; ttl="))
+
+	cache.tiers = []string{hydrator.TierMemory, hydrator.TierDisk}
+	response = get("GET")
+	assert.True(t, strings.HasPrefix(response.Trailer.Get("Cache-Status"), "casserole; hit; ttl="))
+
+	// no blocks are read for HEAD, so it is known up front
+	response = get("HEAD")
+	assert.True(t, strings.HasPrefix(response.Header.Get("Cache-Status"), "casserole; hit; ttl="))
+}
+
+func TestAge(t *testing.T) {
+	assert.Equal(t, "120", age(time.Now().Add(-2*time.Minute)))
+	assert.Equal(t, "0", age(time.Now().Add(time.Minute)))
+}
+
+func TestTraceBlocks(t *testing.T) {
+	trace := hydrator.NewTrace()
+	trace.AddBlock(2, hydrator.TierOrigin)
+	trace.AddBlock(0, hydrator.TierPeer)
+	trace.AddBlock(2, hydrator.TierMemory)
+	assert.Equal(t, "0=peer, 2=origin", trace.Blocks())
+}
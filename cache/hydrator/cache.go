@@ -1,15 +1,53 @@
 package hydrator
 
 import (
+	"errors"
 	"github.com/fkautz/casserole/cache/sizereaderat"
 	"github.com/pquerna/cachecontrol/cacheobject"
+	"io"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 type Cache interface {
-	Get(url string, cacheEntry *CacheEntry) (sizereaderat.SizeReaderAt, error)
-	GetMetadata(url string, clientHeaders http.Header) (*CacheEntry, error)
-	ForceGet(url string) (resp *http.Response, err error)
+	Get(url string, cacheEntry *CacheEntry, trace *Trace) (sizereaderat.SizeReaderAt, error)
+	GetMetadata(url string, clientHeaders http.Header, trace *Trace) (*CacheEntry, error)
+	Forward(url string, request *http.Request) (*http.Response, error)
+	// Purge removes the metadata of every url matching match from the
+	// cluster, and their blocks from every node's disk if blocks is set. It
+	// returns the purged urls.
+	Purge(match PurgeMatch, blocks bool) ([]string, error)
+}
+
+// PurgeMatch selects the urls to purge, relative to the upstream of a
+// cache. It is sent to every node, which purges the urls it knows of.
+type PurgeMatch struct {
+	Url    string `json:",omitempty"`
+	Prefix string `json:",omitempty"`
+	Regex  string `json:",omitempty"`
+}
+
+// Matcher returns a func reporting whether a url matches.
+func (m PurgeMatch) Matcher() (func(url string) bool, error) {
+	switch {
+	case m.Url != "":
+		return func(url string) bool {
+			return url == m.Url
+		}, nil
+	case m.Prefix != "":
+		return func(url string) bool {
+			return strings.HasPrefix(url, m.Prefix)
+		}, nil
+	case m.Regex != "":
+		regex, err := regexp.Compile(m.Regex)
+		if err != nil {
+			return nil, err
+		}
+		return regex.MatchString, nil
+	}
+	return nil, errors.New("one of url, prefix or regex is required")
 }
 
 type CacheEntry struct {
@@ -18,7 +56,45 @@ type CacheEntry struct {
 }
 
 type Hydrator interface {
-	Get(url string, offset int64, length int64) ([]byte, error)
+	// Get fetches bytes [start, end) of the version of url described by
+	// cacheEntry, or returns ObjectChanged if upstream has a new version.
+	Get(url string, start int64, end int64, cacheEntry *CacheEntry) ([]byte, error)
+	// GetObject streams the whole version of url described by cacheEntry.
+	// It is used when Get returns RangeNotSupported.
+	GetObject(url string, cacheEntry *CacheEntry) (io.ReadCloser, error)
 	GetMetadata(url string) (*CacheEntry, error)
-	ForceGet(url string) (*http.Response, error)
+	Revalidate(url string, cacheEntry *CacheEntry) (*CacheEntry, error)
+	// Forward proxies a client request upstream, preserving its method,
+	// body and selected headers.
+	Forward(url string, request *http.Request) (*http.Response, error)
+}
+
+// UnexpectedStatus is returned when upstream answers a metadata request with
+// anything other than 200 (or 304 when revalidating).
+type UnexpectedStatus struct {
+	StatusCode int
+}
+
+func (e UnexpectedStatus) Error() string {
+	return "Unexpected status: " + strconv.Itoa(e.StatusCode)
+}
+
+// ObjectChanged is returned when upstream no longer serves the version of an
+// object whose blocks are being fetched.
+type ObjectChanged struct {
+	Url string
+}
+
+func (e ObjectChanged) Error() string {
+	return "Object changed upstream: " + e.Url
+}
+
+// RangeNotSupported is returned when upstream answers a range request with
+// the whole object.
+type RangeNotSupported struct {
+	Url string
+}
+
+func (e RangeNotSupported) Error() string {
+	return "Range not supported: " + e.Url
 }
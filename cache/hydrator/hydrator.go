@@ -2,7 +2,6 @@ package hydrator
 
 import (
 	"crypto/tls"
-	"errors"
 	"io"
 	"io/ioutil"
 	"log"
@@ -15,31 +14,74 @@ import (
 )
 
 func NewHydrator(urlRoot string) Hydrator {
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-	client.Transport = &http.Transport{
+	var transport http.RoundTripper = &http.Transport{
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: true,
 		},
-		IdleConnTimeout:     30 * time.Second,
-		MaxIdleConns:        0,
-		MaxIdleConnsPerHost: 0,
-		DisableKeepAlives:   false,
+		IdleConnTimeout:       30 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		MaxIdleConns:          0,
+		MaxIdleConnsPerHost:   0,
+		DisableKeepAlives:     false,
+	}
+	transport = instrumentedTransport{base: transport}
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+	}
+	// Proxied responses are streamed to the client as they arrive, so only
+	// the wait for response headers is bounded, and redirects are passed on.
+	proxyClient := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	// Whole objects are streamed to disk, which may take longer than client
+	// allows.
+	downloadClient := &http.Client{
+		Transport: transport,
 	}
 	impl := &hydratorImpl{
-		urlRoot: urlRoot,
-		client:  client,
+		urlRoot:        urlRoot,
+		client:         client,
+		proxyClient:    proxyClient,
+		downloadClient: downloadClient,
 	}
 	return impl
 }
 
 type hydratorImpl struct {
-	urlRoot string
-	client  *http.Client
+	urlRoot        string
+	client         *http.Client
+	proxyClient    *http.Client
+	downloadClient *http.Client
+}
+
+// forwardedHeaders are the client request headers sent upstream when a
+// request is proxied instead of served from the cache.
+var forwardedHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Authorization",
+	"Cache-Control",
+	"Content-Encoding",
+	"Content-Type",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Range",
+	"If-Unmodified-Since",
+	"Pragma",
+	"Range",
+	"User-Agent",
 }
 
-func (h *hydratorImpl) Get(key string, start int64, end int64) ([]byte, error) {
+// Get fetches bytes [start, end) of the version of an object described by
+// cacheEntry. The request carries If-Range with the entry's validator so a
+// changed object is detected instead of mixed with earlier blocks.
+func (h *hydratorImpl) Get(key string, start int64, end int64, cacheEntry *CacheEntry) ([]byte, error) {
 	url := h.urlRoot + "/" + key
 	log.Println("get", url, start, end)
 
@@ -51,23 +93,133 @@ func (h *hydratorImpl) Get(key string, start int64, end int64) ([]byte, error) {
 	}
 	//log.Println("Range", byteRange)
 	request.Header.Add("Range", byteRange)
+	if validator := ifRangeValidator(cacheEntry.Metadata); validator != "" {
+		request.Header.Set("If-Range", validator)
+	}
 	response, err := h.client.Do(request)
 	if err != nil {
 		return nil, err
 	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// If-Range failed, or upstream ignored the range.
+		if !sameVersion(cacheEntry.Metadata, response) {
+			return nil, ObjectChanged{Url: key}
+		}
+		return nil, RangeNotSupported{Url: key}
+	default:
+		return nil, UnexpectedStatus{StatusCode: response.StatusCode}
+	}
+	size, _ := strconv.ParseInt(cacheEntry.Metadata["Content-Length"], 10, 64)
+	if !matchesContentRange(response.Header.Get("Content-Range"), start, end, size) {
+		return nil, ObjectChanged{Url: key}
+	}
 
 	data, err := ioutil.ReadAll(response.Body)
-	response.Body.Close()
 	//time.Sleep(1 * time.Second)
 
 	if err != nil {
 		return nil, err
 	}
+	if int64(len(data)) != end-start {
+		return nil, io.ErrUnexpectedEOF
+	}
 	return data, nil
 }
 
-func (h *hydratorImpl) ForceGet(url string) (*http.Response, error) {
-	return h.client.Get(url)
+// GetObject streams the whole version of an object described by cacheEntry,
+// for upstreams that do not support range requests.
+func (h *hydratorImpl) GetObject(key string, cacheEntry *CacheEntry) (io.ReadCloser, error) {
+	url := h.urlRoot + "/" + key
+	log.Println("get object", url)
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := h.downloadClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, UnexpectedStatus{StatusCode: response.StatusCode}
+	}
+	if !sameVersion(cacheEntry.Metadata, response) {
+		response.Body.Close()
+		return nil, ObjectChanged{Url: key}
+	}
+	return response.Body, nil
+}
+
+// sameVersion reports whether a full response is the version of an object
+// described by metadata.
+func sameVersion(metadata map[string]string, response *http.Response) bool {
+	if length := metadata["Content-Length"]; length != "" && response.ContentLength >= 0 {
+		if length != strconv.FormatInt(response.ContentLength, 10) {
+			return false
+		}
+	}
+	if etag := metadata["Etag"]; etag != "" {
+		return etag == response.Header.Get("Etag")
+	}
+	if lastModified := metadata["Last-Modified"]; lastModified != "" {
+		stored, err := http.ParseTime(strings.Replace(lastModified, "+", " ", -1))
+		if err != nil {
+			return false
+		}
+		modified, err := http.ParseTime(response.Header.Get("Last-Modified"))
+		return err == nil && stored.Equal(modified)
+	}
+	return true
+}
+
+// ifRangeValidator returns the strong Etag or, failing that, the
+// Last-Modified date of an object.
+func ifRangeValidator(metadata map[string]string) string {
+	if etag := metadata["Etag"]; etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	// The http server stores dates with '+' for spaces.
+	return strings.Replace(metadata["Last-Modified"], "+", " ", -1)
+}
+
+// matchesContentRange reports whether a Content-Range header describes
+// bytes [start, end) of an object of size bytes.
+func matchesContentRange(contentRange string, start int64, end int64, size int64) bool {
+	expected := "bytes " + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end-1, 10) + "/"
+	if !strings.HasPrefix(contentRange, expected) {
+		return false
+	}
+	total := contentRange[len(expected):]
+	return total == "*" || total == strconv.FormatInt(size, 10)
+}
+
+func (h *hydratorImpl) Forward(key string, clientRequest *http.Request) (*http.Response, error) {
+	url := h.urlRoot + "/" + key
+	if clientRequest.URL.RawQuery != "" {
+		url = url + "?" + clientRequest.URL.RawQuery
+	}
+
+	// A zero length body must stay nil, otherwise it is sent chunked.
+	var body io.Reader
+	if clientRequest.ContentLength != 0 {
+		body = clientRequest.Body
+	}
+	request, err := http.NewRequest(clientRequest.Method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(clientRequest.Context())
+	request.ContentLength = clientRequest.ContentLength
+	for _, k := range forwardedHeaders {
+		if v, ok := clientRequest.Header[k]; ok {
+			request.Header[k] = v
+		}
+	}
+	return h.proxyClient.Do(request)
 }
 
 func (h *hydratorImpl) GetMetadata(key string) (*CacheEntry, error) {
@@ -86,18 +238,85 @@ func (h *hydratorImpl) GetMetadata(key string) (*CacheEntry, error) {
 	response.Body.Close()
 	//time.Sleep(1 * time.Second)
 
+	return newCacheEntry(request, response)
+}
+
+// Revalidate asks upstream whether an expired cache entry is still current
+// using the stored Etag and Last-Modified validators. On a 304 the stored
+// entry is returned with a new expiration so its blocks remain valid,
+// otherwise the entry is rebuilt from the new response.
+func (h *hydratorImpl) Revalidate(key string, cacheEntry *CacheEntry) (*CacheEntry, error) {
+	url := h.urlRoot + "/" + key
+	request, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag, ok := cacheEntry.Metadata["Etag"]; ok {
+		request.Header.Set("If-None-Match", etag)
+	}
+	if lastModified, ok := cacheEntry.Metadata["Last-Modified"]; ok {
+		request.Header.Set("If-Modified-Since", lastModified)
+	}
+	response, err := h.client.Do(request)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusNotModified {
+		return newCacheEntry(request, response)
+	}
+
+	// A 304 refreshes the stored response, so freshness is computed as if
+	// the stored 200 had been returned with the 304's headers applied.
+	header := make(http.Header)
+	for k, v := range cacheEntry.Metadata {
+		header.Set(k, v)
+	}
+	for k, v := range response.Header {
+		header[k] = v
+	}
+	refreshed := *response
+	refreshed.StatusCode = http.StatusOK
+	refreshed.Header = header
+
+	cacheResults, err := getCacheResult(request, &refreshed)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range cacheEntry.Metadata {
+		metadata[k] = v
+	}
+	metadata["X-Cache-Date-Retrieved"] = response.Header.Get("Date")
+	SetIfNotEmpty(metadata, response.Header, "Cache-Control")
+
+	return &CacheEntry{
+		ObjectResults: cacheResults,
+		Metadata:      metadata,
+	}, nil
+}
+
+func newCacheEntry(request *http.Request, response *http.Response) (*CacheEntry, error) {
 	if response.StatusCode != http.StatusOK {
-		return nil, errors.New("Unexpected status: " + strconv.Itoa(response.StatusCode))
+		return nil, UnexpectedStatus{StatusCode: response.StatusCode}
 	}
 	// log.Println(response.Header)
 
 	metadata := make(map[string]string)
+	SetIfNotEmpty(metadata, response.Header, "Cache-Control")
 	SetIfNotEmpty(metadata, response.Header, "Content-Encodling")
 	SetIfNotEmpty(metadata, response.Header, "Content-Length")
 	SetIfNotEmpty(metadata, response.Header, "Content-MD5")
 	SetIfNotEmpty(metadata, response.Header, "Content-Type")
+	SetIfNotEmpty(metadata, response.Header, "Digest")
 	SetIfNotEmpty(metadata, response.Header, "Etag")
 	SetIfNotEmpty(metadata, response.Header, "Last-Modified")
+	SetIfNotEmpty(metadata, response.Header, "Repr-Digest")
 	metadata["Last-Modified"] = strings.Replace(metadata["Last-Modified"], "+", " ", -1)
 
 	for _, v := range response.TransferEncoding {
@@ -0,0 +1,143 @@
+package hydrator
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevalidateNotModified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Length", "10")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	h := NewHydrator(server.URL)
+	entry, err := h.GetMetadata("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "10", entry.Metadata["Content-Length"])
+
+	entry.ObjectResults.OutExpirationTime = time.Now().Add(-time.Minute)
+	revalidated, err := h.Revalidate("foo", entry)
+	assert.Nil(t, err)
+	assert.Equal(t, "10", revalidated.Metadata["Content-Length"])
+	assert.Equal(t, `"v1"`, revalidated.Metadata["Etag"])
+	assert.True(t, revalidated.ObjectResults.OutExpirationTime.After(time.Now().Add(59*time.Minute)))
+}
+
+func TestRevalidateModified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Etag", `"v2"`)
+		w.Header().Set("Content-Length", "20")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	h := NewHydrator(server.URL)
+	entry := &CacheEntry{
+		Metadata: map[string]string{
+			"Content-Length": "10",
+			"Etag":           `"v1"`,
+		},
+	}
+	revalidated, err := h.Revalidate("foo", entry)
+	assert.Nil(t, err)
+	assert.Equal(t, "20", revalidated.Metadata["Content-Length"])
+	assert.Equal(t, `"v2"`, revalidated.Metadata["Etag"])
+}
+
+func TestForward(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/foo", r.URL.Path)
+		assert.Equal(t, "a=b", r.URL.RawQuery)
+		assert.Equal(t, "hello", string(body))
+		assert.Equal(t, "text/plain", r.Header.Get("Content-Type"))
+		assert.Equal(t, "", r.Header.Get("Cookie"))
+		w.Header().Set("Location", "/bar")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer server.Close()
+
+	clientRequest := httptest.NewRequest("POST", "/foo?a=b", strings.NewReader("hello"))
+	clientRequest.Header.Set("Content-Type", "text/plain")
+	clientRequest.Header.Set("Cookie", "secret")
+
+	h := NewHydrator(server.URL)
+	response, err := h.Forward("foo", clientRequest)
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	assert.Equal(t, "/bar", response.Header.Get("Location"))
+}
+
+func TestGetIfRange(t *testing.T) {
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", etag)
+		http.ServeContent(w, r, "foo", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	defer server.Close()
+
+	h := NewHydrator(server.URL)
+	entry := &CacheEntry{
+		Metadata: map[string]string{
+			"Content-Length": "10",
+			"Etag":           `"v1"`,
+		},
+	}
+	data, err := h.Get("foo", 2, 5, entry)
+	assert.Nil(t, err)
+	assert.Equal(t, "234", string(data))
+
+	entry.Metadata["Content-Length"] = "20"
+	_, err = h.Get("foo", 2, 5, entry)
+	assert.Equal(t, ObjectChanged{Url: "foo"}, err)
+
+	entry.Metadata["Content-Length"] = "10"
+	etag = `"v2"`
+	_, err = h.Get("foo", 2, 5, entry)
+	assert.Equal(t, ObjectChanged{Url: "foo"}, err)
+}
+
+func TestGetRangeNotSupported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v1"`)
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	h := NewHydrator(server.URL)
+	entry := &CacheEntry{
+		Metadata: map[string]string{
+			"Content-Length": "10",
+			"Etag":           `"v1"`,
+		},
+	}
+	_, err := h.Get("foo", 2, 5, entry)
+	assert.Equal(t, RangeNotSupported{Url: "foo"}, err)
+
+	body, err := h.GetObject("foo", entry)
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	assert.Equal(t, "0123456789", string(data))
+
+	entry.Metadata["Etag"] = `"v0"`
+	_, err = h.GetObject("foo", entry)
+	assert.Equal(t, ObjectChanged{Url: "foo"}, err)
+}
@@ -0,0 +1,71 @@
+package hydrator
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	upstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "casserole",
+		Subsystem: "upstream",
+		Name:      "requests_total",
+		Help:      "Requests sent upstream by method and status code.",
+	}, []string{"method", "code"})
+	upstreamBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "casserole",
+		Subsystem: "upstream",
+		Name:      "response_bytes_total",
+		Help:      "Response body bytes read from upstream by method and status code.",
+	}, []string{"method", "code"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "casserole",
+		Subsystem: "upstream",
+		Name:      "request_duration_seconds",
+		Help:      "Time until upstream response headers are received by method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(upstreamRequests, upstreamBytes, upstreamDuration)
+}
+
+// instrumentedTransport records upstream request metrics.
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	start := time.Now()
+	response, err := t.base.RoundTrip(request)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(response.StatusCode)
+	}
+	upstreamRequests.WithLabelValues(request.Method, code).Inc()
+	upstreamDuration.WithLabelValues(request.Method, code).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	response.Body = countingBody{
+		ReadCloser: response.Body,
+		counter:    upstreamBytes.WithLabelValues(request.Method, code),
+	}
+	return response, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (body countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.counter.Add(float64(n))
+	return n, err
+}
@@ -0,0 +1,105 @@
+package hydrator
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Tiers a block can be served from.
+const (
+	TierMemory = "memory"
+	TierPeer   = "peer"
+	TierDisk   = "disk"
+	TierOrigin = "origin"
+)
+
+// Outcomes of a metadata lookup.
+const (
+	MetadataHit                  = "hit"
+	MetadataMiss                 = "miss"
+	MetadataRevalidated          = "revalidated"
+	MetadataStaleWhileRevalidate = "stale-while-revalidate"
+	MetadataStaleIfError         = "stale-if-error"
+)
+
+// A Trace records how a response was served: the outcome of the metadata
+// lookup and which tier served each block. A nil Trace records nothing.
+type Trace struct {
+	lock     sync.Mutex
+	metadata string
+	blocks   map[int64]string
+}
+
+func NewTrace() *Trace {
+	return &Trace{
+		blocks: make(map[int64]string),
+	}
+}
+
+func (t *Trace) SetMetadata(outcome string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	t.metadata = outcome
+	t.lock.Unlock()
+}
+
+func (t *Trace) Metadata() string {
+	if t == nil {
+		return ""
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.metadata
+}
+
+// AddBlock records the tier that served a block. Blocks read more than once
+// keep the tier of their first read.
+func (t *Trace) AddBlock(block int64, tier string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	if _, ok := t.blocks[block]; !ok {
+		t.blocks[block] = tier
+	}
+	t.lock.Unlock()
+}
+
+// Blocks formats the tier of every block read, e.g. "0=memory, 1=disk".
+func (t *Trace) Blocks() string {
+	if t == nil {
+		return ""
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	blocks := make([]int64, 0, len(t.blocks))
+	for block := range t.blocks {
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	parts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		parts = append(parts, strconv.FormatInt(block, 10)+"="+t.blocks[block])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// OriginBlocks returns how many of the blocks read came from the origin, out
+// of how many blocks were read.
+func (t *Trace) OriginBlocks() (origin int, total int) {
+	if t == nil {
+		return 0, 0
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, tier := range t.blocks {
+		if tier == TierOrigin {
+			origin++
+		}
+	}
+	return origin, len(t.blocks)
+}
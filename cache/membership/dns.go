@@ -0,0 +1,141 @@
+package membership
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver is the subset of net.Resolver used for discovery.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DNS discovers peers by polling DNS, e.g. a Kubernetes headless service.
+// Names starting with an underscore, like
+// _peering._tcp.casserole.default.svc.cluster.local, are looked up as SRV
+// records. Other names are looked up as A/AAAA records and use the port of
+// this node's peering address.
+type DNS struct {
+	Name     string
+	Interval time.Duration
+	Resolver Resolver
+}
+
+func NewDNS(name string, interval time.Duration) Membership {
+	return DNS{
+		Name:     name,
+		Interval: interval,
+		Resolver: net.DefaultResolver,
+	}
+}
+
+func (dns DNS) Watch(self string, update func(peers []string)) error {
+	selfUrl, err := url.Parse(self)
+	if err != nil {
+		return err
+	}
+	lookup := func() ([]string, error) {
+		return dns.lookup(selfUrl)
+	}
+	interval := dns.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	current := discover(self, nil, lookup, update)
+	go func() {
+		for {
+			time.Sleep(interval)
+			current = discover(self, current, lookup, update)
+		}
+	}()
+	return nil
+}
+
+func (dns DNS) lookup(self *url.URL) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var peers []string
+	if strings.HasPrefix(dns.Name, "_") {
+		_, records, err := dns.Resolver.LookupSRV(ctx, "", "", dns.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			peers = append(peers, peerUrl(self.Scheme, host, strconv.Itoa(int(record.Port))))
+		}
+		return peers, nil
+	}
+
+	addresses, err := dns.Resolver.LookupHost(ctx, dns.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		peers = append(peers, peerUrl(self.Scheme, address, self.Port()))
+	}
+	return peers, nil
+}
+
+func peerUrl(scheme, host, port string) string {
+	if port == "" {
+		if strings.Contains(host, ":") {
+			return scheme + "://[" + host + "]"
+		}
+		return scheme + "://" + host
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// discover calls update when the peers found by lookup differ from current
+// and returns the peers now in use. self is always one of the peers so a
+// node serves requests before it is published. Lookup failures keep the
+// current peers.
+func discover(self string, current []string, lookup func() ([]string, error), update func(peers []string)) []string {
+	found, err := lookup()
+	if err != nil {
+		log.Println("Unable to discover peers", err)
+		if current != nil {
+			return current
+		}
+	}
+	peers := withSelf(self, found)
+	if !equalPeers(current, peers) {
+		update(peers)
+	}
+	return peers
+}
+
+// withSelf returns the sorted, deduplicated peers including self.
+func withSelf(self string, found []string) []string {
+	peers := []string{self}
+	seen := map[string]bool{self: true}
+	for _, peer := range found {
+		if !seen[peer] {
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func equalPeers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
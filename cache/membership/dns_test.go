@@ -0,0 +1,61 @@
+package membership
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver struct {
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (r fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return name, r.srv[name], nil
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.hosts[host], nil
+}
+
+func watchOnce(t *testing.T, m Membership, self string) []string {
+	peers := make(chan []string, 1)
+	err := m.Watch(self, func(update []string) {
+		select {
+		case peers <- update:
+		default:
+		}
+	})
+	assert.Nil(t, err)
+	return <-peers
+}
+
+func TestDNSHost(t *testing.T) {
+	dns := DNS{
+		Name: "casserole.default.svc.cluster.local",
+		Resolver: fakeResolver{hosts: map[string][]string{
+			"casserole.default.svc.cluster.local": {"10.0.0.2", "10.0.0.1", "fd00::1"},
+		}},
+	}
+	peers := watchOnce(t, dns, "http://10.0.0.1:8000")
+	assert.Equal(t, []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000", "http://[fd00::1]:8000"}, peers)
+}
+
+func TestDNSSRV(t *testing.T) {
+	dns := DNS{
+		Name: "_peering._tcp.casserole.default.svc.cluster.local",
+		Resolver: fakeResolver{srv: map[string][]*net.SRV{
+			"_peering._tcp.casserole.default.svc.cluster.local": {
+				{Target: "casserole-1.casserole.default.svc.cluster.local.", Port: 9000},
+			},
+		}},
+	}
+	peers := watchOnce(t, dns, "http://casserole-0.casserole.default.svc.cluster.local:9000")
+	assert.Equal(t, []string{
+		"http://casserole-0.casserole.default.svc.cluster.local:9000",
+		"http://casserole-1.casserole.default.svc.cluster.local:9000",
+	}, peers)
+}
@@ -0,0 +1,36 @@
+package membership
+
+import (
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/fkautz/peertracker"
+)
+
+// Etcd registers this node in etcd and tracks the other registered nodes.
+type Etcd struct {
+	Endpoints []string
+	Prefix    string
+}
+
+func NewEtcd(endpoints []string, prefix string) Membership {
+	return Etcd{
+		Endpoints: endpoints,
+		Prefix:    prefix,
+	}
+}
+
+func (etcd Etcd) Watch(self string, update func(peers []string)) error {
+	etcdConfig := client.Config{
+		Endpoints: etcd.Endpoints,
+		//Transport:               client.DefaultTransport,
+		//HeaderTimeoutPerRequest: time.Second,
+	}
+	etcdClient, err := client.New(etcdConfig)
+	if err != nil {
+		return err
+	}
+	time.Sleep(2 * time.Second)
+	peertracker.NewPeerTracker(etcdClient, self, etcd.Prefix, 60*time.Second, update)
+	return nil
+}
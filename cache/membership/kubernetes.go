@@ -0,0 +1,211 @@
+package membership
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Kubernetes discovers peers by watching the Endpoints of a service. The
+// service account needs get, list and watch on endpoints.
+type Kubernetes struct {
+	// APIServer is the base url of the Kubernetes api.
+	APIServer string
+	Token     string
+	Namespace string
+	Service   string
+	// Port is the name of the endpoint port to use. When empty, the port of
+	// this node's peering address is used.
+	Port   string
+	Client *http.Client
+}
+
+// NewKubernetes configures discovery from inside a pod. service is
+// "namespace/name" or "name" for the pod's own namespace.
+func NewKubernetes(service, port string) (Membership, error) {
+	host, apiPort := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || apiPort == "" {
+		return nil, errors.New("not running in kubernetes, KUBERNETES_SERVICE_HOST is not set")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("unable to parse " + serviceAccountDir + "/ca.crt")
+	}
+
+	namespace, name := "", service
+	if i := strings.Index(service, "/"); i >= 0 {
+		namespace, name = service[:i], service[i+1:]
+	} else {
+		ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	return Kubernetes{
+		APIServer: "https://" + net.JoinHostPort(host, apiPort),
+		Token:     strings.TrimSpace(string(token)),
+		Namespace: namespace,
+		Service:   name,
+		Port:      port,
+		Client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+type endpoints struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+type watchEvent struct {
+	Type   string    `json:"type"`
+	Object endpoints `json:"object"`
+}
+
+func (k Kubernetes) Watch(self string, update func(peers []string)) error {
+	selfUrl, err := url.Parse(self)
+	if err != nil {
+		return err
+	}
+	update([]string{self})
+	go func() {
+		current := []string{self}
+		publish := func(object endpoints) {
+			peers := withSelf(self, k.peers(selfUrl, object))
+			if !equalPeers(current, peers) {
+				current = peers
+				update(peers)
+			}
+		}
+		for {
+			if err := k.watch(publish); err != nil {
+				log.Println("Unable to watch endpoints", k.Namespace+"/"+k.Service, err)
+				time.Sleep(5 * time.Second)
+			}
+		}
+	}()
+	return nil
+}
+
+// watch lists the endpoints, then follows changes until the watch ends.
+func (k Kubernetes) watch(publish func(endpoints)) error {
+	path := "/api/v1/namespaces/" + url.PathEscape(k.Namespace) + "/endpoints"
+	response, err := k.get(path + "/" + url.PathEscape(k.Service))
+	if err != nil {
+		return err
+	}
+	var object endpoints
+	err = json.NewDecoder(response.Body).Decode(&object)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	publish(object)
+
+	query := url.Values{
+		"watch":           {"true"},
+		"fieldSelector":   {"metadata.name=" + k.Service},
+		"resourceVersion": {object.Metadata.ResourceVersion},
+	}
+	response, err = k.get(path + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			publish(event.Object)
+		case "DELETED":
+			publish(endpoints{})
+		case "ERROR":
+			return errors.New("watch error")
+		}
+	}
+}
+
+func (k Kubernetes) get(path string) (*http.Response, error) {
+	request, err := http.NewRequest("GET", k.APIServer+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if k.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+k.Token)
+	}
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, errors.New("Unexpected status: " + response.Status)
+	}
+	return response, nil
+}
+
+// peers returns the peering addresses of the ready endpoints.
+func (k Kubernetes) peers(self *url.URL, object endpoints) []string {
+	var peers []string
+	for _, subset := range object.Subsets {
+		port := self.Port()
+		if k.Port != "" {
+			port = ""
+			for _, p := range subset.Ports {
+				if p.Name == k.Port {
+					port = strconv.Itoa(p.Port)
+				}
+			}
+			if port == "" {
+				continue
+			}
+		}
+		for _, address := range subset.Addresses {
+			peers = append(peers, peerUrl(self.Scheme, address.IP, port))
+		}
+	}
+	return peers
+}
@@ -0,0 +1,48 @@
+package membership
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKubernetesWatch(t *testing.T) {
+	events := make(chan string)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("watch") != "true" {
+			assert.Equal(t, "/api/v1/namespaces/cache/endpoints/casserole", r.URL.Path)
+			fmt.Fprint(w, `{"metadata":{"resourceVersion":"7"},"subsets":[{"addresses":[{"ip":"10.0.0.1"}],"ports":[{"name":"peering","port":8000}]}]}`)
+			return
+		}
+		assert.Equal(t, "7", r.URL.Query().Get("resourceVersion"))
+		assert.Equal(t, "metadata.name=casserole", r.URL.Query().Get("fieldSelector"))
+		for event := range events {
+			fmt.Fprintln(w, event)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer api.Close()
+	defer close(events)
+
+	k := Kubernetes{
+		APIServer: api.URL,
+		Token:     "secret",
+		Namespace: "cache",
+		Service:   "casserole",
+		Port:      "peering",
+	}
+	updates := make(chan []string, 10)
+	assert.Nil(t, k.Watch("http://10.0.0.1:8000", func(peers []string) {
+		updates <- peers
+	}))
+
+	assert.Equal(t, []string{"http://10.0.0.1:8000"}, <-updates)
+	events <- `{"type":"MODIFIED","object":{"subsets":[{"addresses":[{"ip":"10.0.0.1"},{"ip":"10.0.0.2"}],"ports":[{"name":"peering","port":8000}]}]}}`
+	assert.Equal(t, []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000"}, <-updates)
+	events <- `{"type":"MODIFIED","object":{"subsets":[{"addresses":[{"ip":"10.0.0.2"}],"ports":[{"name":"other","port":9000}]}]}}`
+	assert.Equal(t, []string{"http://10.0.0.1:8000"}, <-updates)
+}
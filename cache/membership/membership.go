@@ -0,0 +1,38 @@
+package membership
+
+// Membership tells a node which peers make up its cluster.
+type Membership interface {
+	// Watch calls update with the peering addresses of the cluster,
+	// including self, and again whenever they change.
+	Watch(self string, update func(peers []string)) error
+}
+
+// Standalone is a cluster of one. Nothing is shared with other nodes.
+type Standalone struct{}
+
+func (_ Standalone) Watch(self string, update func(peers []string)) error {
+	update([]string{self})
+	return nil
+}
+
+// Static is a fixed list of peering addresses.
+type Static struct {
+	Peers []string
+}
+
+func NewStatic(peers []string) Membership {
+	return Static{
+		Peers: peers,
+	}
+}
+
+func (static Static) Watch(self string, update func(peers []string)) error {
+	peers := []string{self}
+	for _, peer := range static.Peers {
+		if peer != self {
+			peers = append(peers, peer)
+		}
+	}
+	update(peers)
+	return nil
+}
@@ -0,0 +1,16 @@
+package membership
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStandalone(t *testing.T) {
+	assert.Equal(t, []string{"http://self:8000"}, watchOnce(t, Standalone{}, "http://self:8000"))
+}
+
+func TestStatic(t *testing.T) {
+	static := NewStatic([]string{"http://a:8000", "http://self:8000", "http://b:8000"})
+	assert.Equal(t, []string{"http://self:8000", "http://a:8000", "http://b:8000"}, watchOnce(t, static, "http://self:8000"))
+}
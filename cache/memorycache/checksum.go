@@ -0,0 +1,72 @@
+package gcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/fkautz/casserole/cache/diskcache"
+	"github.com/golang/groupcache/lru"
+)
+
+// Blocks travel through groupcache with the sha256 of their data appended,
+// so blocks served from memory or by a peer are verified like blocks read
+// from disk. Mismatches are reported as diskcache.ChecksumMismatch.
+
+func sealBlock(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return append(data[:len(data):len(data)], sum[:]...)
+}
+
+func openBlock(key string, value []byte) ([]byte, error) {
+	if len(value) < sha256.Size {
+		return nil, diskcache.ChecksumMismatch{Key: key}
+	}
+	data := value[:len(value)-sha256.Size]
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], value[len(data):]) {
+		return nil, diskcache.ChecksumMismatch{Key: key}
+	}
+	return data, nil
+}
+
+// corruptBlocks counts the corrupt values groupcache returned for a block,
+// by its groupcache key. Groupcache cannot remove a value, so a block is
+// read under a key with the count, as a purge starts a new generation, and
+// the corrupt value is never read again and ages out.
+var corruptBlocks = newBlockRetries(10000)
+
+type blockRetries struct {
+	lock sync.Mutex
+	lru  *lru.Cache
+}
+
+func newBlockRetries(maxEntries int) *blockRetries {
+	return &blockRetries{lru: lru.New(maxEntries)}
+}
+
+// get returns how many corrupt values a block had.
+func (retries *blockRetries) get(key string) int64 {
+	retries.lock.Lock()
+	defer retries.lock.Unlock()
+	if count, ok := retries.lru.Get(key); ok {
+		return count.(int64)
+	}
+	return 0
+}
+
+// bump records that the value read after seen corrupt values was corrupt
+// too, once for readers that saw it at once, and returns the new count.
+func (retries *blockRetries) bump(key string, seen int64) int64 {
+	retries.lock.Lock()
+	defer retries.lock.Unlock()
+	count := int64(0)
+	if value, ok := retries.lru.Get(key); ok {
+		count = value.(int64)
+	}
+	if count == seen {
+		count++
+		retries.lru.Add(key, count)
+	}
+	return count
+}
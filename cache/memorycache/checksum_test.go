@@ -0,0 +1,48 @@
+package gcache
+
+import (
+	"testing"
+
+	"github.com/fkautz/casserole/cache/diskcache"
+	"github.com/golang/groupcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenBlock(t *testing.T) {
+	value := sealBlock([]byte("hello"))
+	data, err := openBlock("block", value)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	value[0] = 'j'
+	_, err = openBlock("block", value)
+	assert.Equal(t, diskcache.ChecksumMismatch{Key: "block"}, err)
+	_, err = openBlock("block", []byte("short"))
+	assert.Equal(t, diskcache.ChecksumMismatch{Key: "block"}, err)
+}
+
+func TestCorruptBlockRefetched(t *testing.T) {
+	calls := 0
+	groupcache.NewGroup("testcorruptblockrefetched", 1<<20, groupcache.GetterFunc(func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
+		calls++
+		value := sealBlock([]byte("hello"))
+		if calls == 1 {
+			value[0] = 'j'
+		}
+		return dest.SetBytes(value)
+	}))
+	reader := lazyReaderAt{
+		request:   dataRequest{MetadataRequest: MetadataRequest{Url: "foo", Key: "key"}, BlockSize: 5, Size: 5},
+		size:      5,
+		groupName: "testcorruptblockrefetched",
+	}
+
+	// The corrupt value stays in groupcache, it is read once.
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 5)
+		n, err := reader.ReadAt(data, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(data[:n]))
+	}
+	assert.Equal(t, 2, calls)
+}
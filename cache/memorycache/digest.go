@@ -0,0 +1,232 @@
+package gcache
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// Objects are assembled from blocks fetched with separate range requests,
+// so an object that changes upstream mid-download can be stitched together
+// from two versions. Objects whose upstream sent a digest are verified
+// against it once every block has been read on this node. Blocks are hashed
+// as they are streamed to clients, in order, so verifying reads nothing
+// again; objects only ever read in part, or in parts on different nodes,
+// are not verified.
+
+type digest struct {
+	algorithm string
+	sum       []byte
+}
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// parseDigests returns the digests in the Content-MD5, RFC 3230 Digest and
+// RFC 9530 Repr-Digest metadata of an object. Unknown algorithms are
+// ignored.
+func parseDigests(metadata map[string]string) []digest {
+	var digests []digest
+	add := func(algorithm, value string) {
+		algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+		if _, ok := digestAlgorithms[algorithm]; !ok {
+			return
+		}
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return
+		}
+		digests = append(digests, digest{algorithm: algorithm, sum: sum})
+	}
+	if v, ok := metadata["Content-MD5"]; ok {
+		add("md5", v)
+	}
+	for _, field := range []string{"Digest", "Repr-Digest"} {
+		for _, member := range strings.Split(metadata[field], ",") {
+			i := strings.Index(member, "=")
+			if i < 0 {
+				continue
+			}
+			value := strings.TrimSpace(member[i+1:])
+			if field == "Repr-Digest" {
+				// structured field byte sequence, :base64:
+				if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+					continue
+				}
+				value = value[1 : len(value)-1]
+			}
+			add(member[:i], value)
+		}
+	}
+	return digests
+}
+
+// newHashes returns a hash for each digest.
+func newHashes(digests []digest) []hash.Hash {
+	hashes := make([]hash.Hash, len(digests))
+	for i, d := range digests {
+		hashes[i] = digestAlgorithms[d.algorithm]()
+	}
+	return hashes
+}
+
+// matchDigests reports whether the hashes match every digest.
+func matchDigests(hashes []hash.Hash, digests []digest) bool {
+	for i, d := range digests {
+		if !bytes.Equal(hashes[i].Sum(nil), d.sum) {
+			return false
+		}
+	}
+	return true
+}
+
+// objectVerifier hashes the blocks of each object as they are read, so
+// objects are verified once all have been, and tracks which versions of
+// objects changed upstream.
+type objectVerifier struct {
+	lock sync.Mutex
+	// block key -> *objectProgress
+	progress *lru.Cache
+	// block keys of objects that changed upstream while being fetched
+	changed *lru.Cache
+}
+
+// untrustedVersions holds the block keys of objects that failed
+// verification on any node. Keys are unique across groups, see namespace.
+var untrustedVersions = newKeySet(10000)
+
+// keySet is a set of keys, the least recently added are forgotten first.
+type keySet struct {
+	lock sync.Mutex
+	lru  *lru.Cache
+	keys map[string]bool
+}
+
+func newKeySet(maxEntries int) *keySet {
+	set := &keySet{
+		lru:  lru.New(maxEntries),
+		keys: make(map[string]bool),
+	}
+	set.lru.OnEvicted = func(key lru.Key, value interface{}) {
+		delete(set.keys, key.(string))
+	}
+	return set
+}
+
+func (set *keySet) add(key string) {
+	set.lock.Lock()
+	set.lru.Add(key, true)
+	set.keys[key] = true
+	set.lock.Unlock()
+}
+
+func (set *keySet) contains(key string) bool {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	return set.keys[key]
+}
+
+func (set *keySet) list() []string {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	keys := make([]string, 0, len(set.keys))
+	for key := range set.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// objectProgress hashes the blocks of an object in order. Blocks read out
+// of order are skipped, a sequential reader reads them again later.
+type objectProgress struct {
+	lock   sync.Mutex
+	hashes []hash.Hash
+	next   int64
+}
+
+func newObjectVerifier() *objectVerifier {
+	return &objectVerifier{
+		progress: lru.New(10000),
+		changed:  lru.New(10000),
+	}
+}
+
+// blockRead hashes a block of an object when it is the next one, calling
+// data for its contents, and returns true when it completes the object, at
+// most once per object, along with whether the object matched every
+// digest.
+func (v *objectVerifier) blockRead(key string, block, blockCount int64, digests []digest, data func() ([]byte, error)) (done bool, ok bool) {
+	v.lock.Lock()
+	value, found := v.progress.Get(key)
+	if !found {
+		value = &objectProgress{hashes: newHashes(digests)}
+		v.progress.Add(key, value)
+	}
+	v.lock.Unlock()
+	progress := value.(*objectProgress)
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+	if block != progress.next || progress.next >= blockCount {
+		return false, false
+	}
+	contents, err := data()
+	if err != nil {
+		return false, false
+	}
+	for _, h := range progress.hashes {
+		h.Write(contents)
+	}
+	progress.next++
+	if progress.next < blockCount {
+		return false, false
+	}
+	ok = matchDigests(progress.hashes, digests)
+	progress.hashes = nil
+	return true, ok
+}
+
+func (v *objectVerifier) isChanged(key string) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	_, ok := v.changed.Get(key)
+	return ok
+}
+
+// markChanged marks a version as changed and returns false when it already
+// was.
+func (v *objectVerifier) markChanged(key string) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if _, ok := v.changed.Get(key); ok {
+		return false
+	}
+	v.changed.Add(key, true)
+	return true
+}
+
+// verified records the outcome of verifying an object. A mismatching
+// object is purged from the cluster and marked untrusted on every node, so
+// it is forwarded upstream until upstream serves a different version. Nodes
+// joining the cluster pull the untrusted versions from their peers.
+func (mc *memoryCache) verified(url string, key string, size int64, ok bool) {
+	if ok {
+		objectVerifications.WithLabelValues(mc.groupName, "ok").Inc()
+		return
+	}
+	log.Println("Digest mismatch, purging", url)
+	objectVerifications.WithLabelValues(mc.groupName, "mismatch").Inc()
+	mc.dropVersion(objectVersion{Url: url, Key: key, Size: size, Untrusted: true})
+}
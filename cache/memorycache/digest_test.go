@@ -0,0 +1,163 @@
+package gcache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseDigests(t *testing.T) {
+	digests := parseDigests(map[string]string{
+		"Content-MD5": "XUFAKrxLKna5cZ2REBfFkg==",
+		"Digest":      "SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=, UNIXsum=30637",
+		"Repr-Digest": "sha-512=:m3HSJL1i83hdltRq0+o9czGb+8KJDKra4t/3JRlnPKcjI8PZm6XBHXx6zG4UuMXaDEZjR1wuXDre9G9zvN7AQw==:, sha-256=:invalid",
+	})
+	var algorithms []string
+	for _, d := range digests {
+		algorithms = append(algorithms, d.algorithm)
+	}
+	assert.Equal(t, []string{"md5", "sha-256", "sha-512"}, algorithms)
+
+	verify := func(key string, blocks ...string) (bool, bool) {
+		verifier := newObjectVerifier()
+		var done, ok bool
+		for i, block := range blocks {
+			data := []byte(block)
+			done, ok = verifier.blockRead(key, int64(i), int64(len(blocks)), digests, func() ([]byte, error) { return data, nil })
+		}
+		return done, ok
+	}
+	done, ok := verify("hello", "hel", "lo")
+	assert.True(t, done)
+	assert.True(t, ok)
+	_, ok = verify("jello", "jel", "lo")
+	assert.False(t, ok)
+}
+
+func TestBlockReadInOrder(t *testing.T) {
+	digests := parseDigests(map[string]string{"Content-MD5": "XUFAKrxLKna5cZ2REBfFkg=="})
+	verifier := newObjectVerifier()
+	read := func(block int64, data string) (bool, bool) {
+		return verifier.blockRead("key", block, 2, digests, func() ([]byte, error) { return []byte(data), nil })
+	}
+	done, _ := read(1, "lo")
+	assert.False(t, done, "out of order")
+	read(0, "hel")
+	read(0, "hel")
+	done, ok := read(1, "lo")
+	assert.True(t, done)
+	assert.True(t, ok)
+	done, _ = read(1, "lo")
+	assert.False(t, done, "once per object")
+}
+
+func TestDigestMismatch(t *testing.T) {
+	upstream := new(testHydrator)
+	diskCache := new(testDiskCache)
+	diskCache.On("Get", mock.AnythingOfType("string")).Return(nil, errors.New("Not Found"))
+	diskCache.On("Admit", mock.AnythingOfType("string"), int64(5)).Return(true)
+	diskCache.On("Put", mock.AnythingOfType("string"), mock.Anything).Return(nil)
+	diskCache.On("Expires", mock.AnythingOfType("string"), mock.AnythingOfType("time.Time"))
+	diskCache.On("Remove", mock.AnythingOfType("string"))
+	upstream.On("Get", "foo", int64(0), int64(5), mock.Anything).Return([]byte("jello"), nil)
+
+	cacheEntry := &hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{OutExpirationTime: time.Now().Add(time.Hour)},
+		Metadata: map[string]string{
+			"Content-Length": "5",
+			"Content-MD5":    "XUFAKrxLKna5cZ2REBfFkg==",
+			"Etag":           `"v1"`,
+		},
+	}
+	upstream.On("GetMetadata", "foo").Return(cacheEntry, nil)
+
+	// Too little memory to keep the block, so reading it again would fetch
+	// it from upstream again.
+	cache := NewCache(Config{
+		BlockSize:      int64(1 * 1024 * 1024),
+		MaxMemoryUsage: 1,
+		Hydrator:       upstream,
+		DiskCache:      diskCache,
+		GroupName:      "testdigestmismatch",
+	})
+	cacheEntry, err := cache.GetMetadata("foo", nil, nil)
+	assert.Nil(t, err)
+	reader, err := cache.Get("foo", cacheEntry, nil)
+	assert.Nil(t, err)
+	reader.ReadAt(make([]byte, 5), 0)
+
+	for i := 0; i < 100 && !cache.(*memoryCache).isUntrusted("foo", cacheEntry); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = cache.GetMetadata("foo", nil, nil)
+	assert.Equal(t, NotCacheable{}, err)
+	diskCache.AssertCalled(t, "Remove", mock.AnythingOfType("string"))
+	upstream.AssertNumberOfCalls(t, "Get", 1)
+}
+
+// newDigestCache returns a cache of foo, "hello" in blocks of 4 bytes with
+// a digest that does not match what upstream serves.
+func newDigestCache(t *testing.T, group string) (*memoryCache, *testHydrator, *hydrator.CacheEntry) {
+	upstream := new(testHydrator)
+	upstream.On("Get", "foo", int64(0), int64(4), mock.Anything).Return([]byte("jell"), nil)
+	cache := NewCache(Config{
+		BlockSize:      4,
+		MaxMemoryUsage: 64 * 1024 * 1024,
+		Hydrator:       upstream,
+		DiskCache:      &mapDiskCache{blocks: make(map[string][]byte)},
+		GroupName:      group,
+	}).(*memoryCache)
+	cacheEntry := &hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{OutExpirationTime: time.Now().Add(time.Hour)},
+		Metadata: map[string]string{
+			"Content-Length": "5",
+			"Content-MD5":    "XUFAKrxLKna5cZ2REBfFkg==",
+			"Etag":           `"v1"`,
+		},
+	}
+	return cache, upstream, cacheEntry
+}
+
+func TestDigestMismatchOnPeers(t *testing.T) {
+	cache, upstream, cacheEntry := newDigestCache(t, "testdigestmismatchonpeers")
+	upstream.On("Get", "foo", int64(4), int64(5), mock.Anything).Return([]byte("o"), nil)
+	remote, remoteDisk := newRemoteCache(t, "testdigestmismatchonpeers")
+	received := addPeer(t, remote)
+	key, err := cache.objectKey("foo", cacheEntry)
+	assert.Nil(t, err)
+	remote.metadata.AddWithoutSync(remote.namespace("foo"), *cacheEntry)
+	remoteDisk.blocks[key+"-1"] = []byte("o")
+
+	reader, err := cache.Get("foo", cacheEntry, nil)
+	assert.Nil(t, err)
+	reader.ReadAt(make([]byte, 5), 0)
+	for i := 0; i < 100 && remoteDisk.len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, 1, received())
+	assert.True(t, untrustedVersions.contains(key))
+	assert.False(t, remote.verifier.isChanged(key))
+	_, ok := remote.metadata.Get(remote.namespace("foo"), nil)
+	assert.False(t, ok)
+	assert.Equal(t, 0, remoteDisk.len())
+}
+
+func TestDigestPartialRead(t *testing.T) {
+	cache, upstream, cacheEntry := newDigestCache(t, "testdigestpartialread")
+	reader, err := cache.Get("foo", cacheEntry, nil)
+	assert.Nil(t, err)
+	_, err = reader.ReadAt(make([]byte, 4), 0)
+	assert.Nil(t, err)
+
+	// Only the first block was read on this node, the object is not
+	// verified, so the second block is never fetched.
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, cache.isUntrusted("foo", cacheEntry))
+	upstream.AssertNotCalled(t, "Get", "foo", int64(4), int64(5), mock.Anything)
+}
@@ -0,0 +1,313 @@
+package gcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/fkautz/casserole/cache/hydrator"
+)
+
+// Upstreams that ignore range requests answer every block fetch with the
+// whole object. Such objects are downloaded by the node owning their first
+// block, and split into blocks on its disk as they stream, so each block
+// request waits only for its own block. Blocks of other nodes are sent to
+// them. Those, and blocks the disk cache does not admit, are removed from
+// this node once read.
+
+// downloadPath is served on the peering address and returns a block of an
+// object downloaded whole by this node.
+const downloadPath = "/_casserole/download"
+
+type objectDownload struct {
+	// ready[i] is closed once block i is on disk.
+	ready []chan struct{}
+	// done is closed when the download ends, err is set before.
+	done chan struct{}
+	err  error
+
+	// Guarded by downloadsLock.
+	// readers counts the requests waiting for or reading a block.
+	readers int
+	// finished is set when the download ends.
+	finished bool
+	// discard holds the disk keys of blocks stored only for readers,
+	// removed once the download is finished and no reader remains.
+	discard []string
+}
+
+var (
+	downloadsLock sync.Mutex
+	downloads     = make(map[string]*objectDownload)
+)
+
+// rangeUnsupported holds the keys of versions whose upstream ignored a
+// range request, so their other blocks are not requested by range first.
+var rangeUnsupported = newKeySet(10000)
+
+// downloadBlock returns a block of an object from a whole object download
+// by the node owning its first block, or this node if the owner cannot be
+// reached.
+func downloadBlock(ctx cacheContext, info dataRequest) ([]byte, error) {
+	if info.Block*info.BlockSize >= info.Size {
+		// the empty block after an object ending on a block boundary
+		return []byte{}, nil
+	}
+	first := info
+	first.Block = 0
+	owner, err := clusterPeers.owner(first)
+	if err != nil || owner == "" || owner == clusterPeers.self {
+		return downloadLocally(ctx, info)
+	}
+	data, err := downloadFromPeer(owner, ctx.groupName, info)
+	if err != nil {
+		log.Println("Unable to download", info.Url, "from", owner, err)
+		return downloadLocally(ctx, info)
+	}
+	if ctx.diskCache != nil {
+		diskKey := info.Key + "-" + strconv.FormatInt(info.Block, 10)
+		if ctx.diskCache.Admit(diskKey, int64(len(data))) {
+			if err := ctx.diskCache.Put(diskKey, bytes.NewReader(data)); err == nil {
+				expireBlock(ctx, diskKey, info)
+			}
+		}
+	}
+	return data, nil
+}
+
+// downloadLocally returns a block of an object from disk or from a whole
+// object download on this node, starting one unless it is already running.
+func downloadLocally(ctx cacheContext, info dataRequest) ([]byte, error) {
+	if ctx.diskCache == nil {
+		return nil, errors.New("Range not supported upstream and no disk cache to split the object into")
+	}
+	if info.Block < 0 || info.Block*info.BlockSize >= info.Size {
+		return nil, errors.New("Block out of range: " + strconv.FormatInt(info.Block, 10))
+	}
+	diskKey := info.Key + "-" + strconv.FormatInt(info.Block, 10)
+	if reader, err := ctx.diskCache.Get(diskKey); err == nil {
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+	download := startDownload(ctx, info)
+	defer download.release(ctx)
+	select {
+	case <-download.ready[info.Block]:
+	case <-download.done:
+		select {
+		case <-download.ready[info.Block]:
+		default:
+			return nil, download.err
+		}
+	}
+	reader, err := ctx.diskCache.Get(diskKey)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// startDownload returns the running download of an object, or starts one,
+// as a reader of it.
+func startDownload(ctx cacheContext, info dataRequest) *objectDownload {
+	downloadsLock.Lock()
+	defer downloadsLock.Unlock()
+	// block sizes are set per node, a download is split for one
+	key := info.Key + "/" + strconv.FormatInt(info.BlockSize, 10)
+	if download, ok := downloads[key]; ok {
+		download.readers++
+		return download
+	}
+	blockCount := (info.Size + info.BlockSize - 1) / info.BlockSize
+	download := &objectDownload{
+		ready:   make([]chan struct{}, blockCount),
+		done:    make(chan struct{}),
+		readers: 1,
+	}
+	for i := range download.ready {
+		download.ready[i] = make(chan struct{})
+	}
+	downloads[key] = download
+	go func() {
+		download.err = download.run(ctx, info)
+		downloadsLock.Lock()
+		delete(downloads, key)
+		download.finished = true
+		download.cleanup(ctx)
+		downloadsLock.Unlock()
+		close(download.done)
+	}()
+	return download
+}
+
+// release ends a reader of the download.
+func (download *objectDownload) release(ctx cacheContext) {
+	downloadsLock.Lock()
+	download.readers--
+	download.cleanup(ctx)
+	downloadsLock.Unlock()
+}
+
+// cleanup removes the discarded blocks once they can no longer be read,
+// with downloadsLock held.
+func (download *objectDownload) cleanup(ctx cacheContext) {
+	if !download.finished || download.readers > 0 {
+		return
+	}
+	removeBlocks(ctx.diskCache, download.discard)
+	download.discard = nil
+}
+
+func (download *objectDownload) run(ctx cacheContext, info dataRequest) error {
+	body, err := ctx.hydrator.GetObject(info.Url, &hydrator.CacheEntry{Metadata: info.Headers})
+	if _, ok := err.(hydrator.ObjectChanged); ok && ctx.changed != nil {
+		ctx.changed(info.Url, info.Key, info.Size)
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	buf := make([]byte, info.BlockSize)
+	for block := range download.ready {
+		start := int64(block) * info.BlockSize
+		length := info.Size - start
+		if length > info.BlockSize {
+			length = info.BlockSize
+		}
+		if _, err := io.ReadFull(body, buf[:length]); err != nil {
+			return err
+		}
+		diskKey := info.Key + "-" + strconv.Itoa(block)
+		// stored whether or not this node keeps it, waiting requests read
+		// it from disk
+		err := ctx.diskCache.Put(diskKey, bytes.NewReader(buf[:length]))
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err == nil {
+			request := info
+			request.Block = int64(block)
+			key, keyErr := request.groupKey()
+			if keyErr == nil && ownedLocally(key) && ctx.diskCache.Admit(diskKey, length) {
+				expireBlock(ctx, diskKey, info)
+			} else {
+				downloadsLock.Lock()
+				download.discard = append(download.discard, diskKey)
+				downloadsLock.Unlock()
+			}
+		}
+		close(download.ready[block])
+	}
+	return nil
+}
+
+// downloadFromPeer asks the node owning the first block of an object for
+// another of its blocks.
+func downloadFromPeer(peer string, group string, info dataRequest) ([]byte, error) {
+	body, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"group": {group}}.Encode()
+	request, err := http.NewRequest("POST", peer+downloadPath+"?"+query, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := peerRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// a truncated block must not reach the disk cache
+	length := info.Size - info.Block*info.BlockSize
+	if length > info.BlockSize {
+		length = info.BlockSize
+	}
+	if int64(len(data)) != length {
+		return nil, errors.New("Short block from " + peer + ": " + strconv.Itoa(len(data)) + " of " + strconv.FormatInt(length, 10) + " bytes")
+	}
+	return data, nil
+}
+
+// checkDownload rejects block requests of peers that this node would split
+// differently or that do not match the version they name: another block
+// size, a block out of range, or a size that is not the one of the
+// metadata of the version. The metadata is the one this node holds for the
+// url, or else the headers the key of the version is generated from.
+func (mc *memoryCache) checkDownload(info dataRequest) error {
+	if info.BlockSize != mc.blockSize {
+		return errors.New("Block size " + strconv.FormatInt(info.BlockSize, 10) + " is not " + strconv.FormatInt(mc.blockSize, 10))
+	}
+	if info.Block < 0 || info.Block*info.BlockSize >= info.Size {
+		return errors.New("Block out of range: " + strconv.FormatInt(info.Block, 10))
+	}
+	cacheEntry := &hydrator.CacheEntry{Metadata: info.Headers}
+	if held, ok := mc.metadata.Get(mc.namespace(info.Url), nil); ok {
+		if key, err := mc.objectKey(info.Url, held); err == nil && key == info.Key {
+			cacheEntry = held
+		}
+	}
+	if key, err := mc.objectKey(info.Url, cacheEntry); err != nil || key != info.Key {
+		return errors.New("Version does not match its key: " + info.Key)
+	}
+	size, err := strconv.ParseInt(cacheEntry.Metadata["Content-Length"], 10, 64)
+	if err != nil || size != info.Size {
+		return errors.New("Size does not match the metadata: " + strconv.FormatInt(info.Size, 10))
+	}
+	return nil
+}
+
+// downloadHandler serves downloadPath to the peers of this node.
+func downloadHandler(peers *peerList, lookup func(group string) *memoryCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !peers.authorized(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		mc := lookup(r.URL.Query().Get("group"))
+		if mc == nil {
+			http.NotFound(w, r)
+			return
+		}
+		var info dataRequest
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !objectKeyRegex.MatchString(info.Key) {
+			http.Error(w, "invalid block request", http.StatusBadRequest)
+			return
+		}
+		if err := mc.checkDownload(info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rangeUnsupported.add(info.Key)
+		data, err := downloadLocally(mc.context, info)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	})
+}
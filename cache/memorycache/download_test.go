@@ -0,0 +1,323 @@
+package gcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/golang/groupcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// mapDiskCache is a disk cache in memory. It admits no block if reject is
+// set, and records expiries if expires is set.
+type mapDiskCache struct {
+	lock    sync.Mutex
+	blocks  map[string][]byte
+	reject  bool
+	expires map[string]time.Time
+}
+
+func (c *mapDiskCache) Get(key string) (io.ReadCloser, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	data, ok := c.blocks[key]
+	if !ok {
+		return nil, errors.New("Not Found")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (c *mapDiskCache) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	return nil, errors.New("Not Implemented")
+}
+
+func (c *mapDiskCache) Hit(key string) error { return nil }
+
+func (c *mapDiskCache) Put(key string, reader io.Reader) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.blocks[key] = data
+	return nil
+}
+
+func (c *mapDiskCache) Remove(key string) {
+	c.lock.Lock()
+	delete(c.blocks, key)
+	c.lock.Unlock()
+}
+
+func (c *mapDiskCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.blocks)
+}
+
+func (c *mapDiskCache) Shutdown() error { return nil }
+
+func (c *mapDiskCache) Admit(key string, size int64) bool { return !c.reject }
+
+func (c *mapDiskCache) Expires(key string, expires time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.expires != nil {
+		c.expires[key] = expires
+	}
+}
+
+func (c *mapDiskCache) GetFile(key string) (*os.File, error) {
+	return nil, errors.New("Not Implemented")
+}
+
+func TestDownloadBlock(t *testing.T) {
+	upstream := new(testHydrator)
+	upstream.On("GetObject", "foo", mock.Anything).Return(ioutil.NopCloser(bytes.NewReader([]byte("0123456789"))), nil).Once()
+	diskCache := &mapDiskCache{blocks: make(map[string][]byte), expires: make(map[string]time.Time)}
+	ctx := cacheContext{
+		diskCache: diskCache,
+		hydrator:  upstream,
+	}
+
+	info := dataRequest{
+		MetadataRequest: MetadataRequest{Url: "foo", Key: "key"},
+		Block:           1,
+		Size:            10,
+		BlockSize:       4,
+		Expires:         1500000000,
+	}
+	data, err := downloadBlock(ctx, info)
+	assert.Nil(t, err)
+	assert.Equal(t, "4567", string(data))
+
+	// the rest of the object is stored in the background
+	for i := 0; i < 100 && diskCache.len() < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, map[string][]byte{
+		"key-0": []byte("0123"),
+		"key-1": []byte("4567"),
+		"key-2": []byte("89"),
+	}, diskCache.blocks)
+	diskCache.lock.Lock()
+	assert.Equal(t, time.Unix(1500000000, 0), diskCache.expires["key-2"], "expiry sent with the request")
+	diskCache.lock.Unlock()
+	upstream.AssertExpectations(t)
+}
+
+func TestDownloadBlockNotAdmitted(t *testing.T) {
+	upstream := new(testHydrator)
+	upstream.On("GetObject", "foo", mock.Anything).Return(ioutil.NopCloser(bytes.NewReader([]byte("0123456789"))), nil).Once()
+	diskCache := &mapDiskCache{blocks: make(map[string][]byte), reject: true}
+	ctx := cacheContext{
+		diskCache: diskCache,
+		hydrator:  upstream,
+	}
+
+	info := dataRequest{
+		MetadataRequest: MetadataRequest{Url: "foo", Key: "key"},
+		Block:           1,
+		Size:            10,
+		BlockSize:       4,
+	}
+	data, err := downloadBlock(ctx, info)
+	assert.Nil(t, err)
+	assert.Equal(t, "4567", string(data))
+
+	// blocks the disk cache does not admit are only kept for readers
+	for i := 0; i < 100 && diskCache.len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, diskCache.len())
+	upstream.AssertExpectations(t)
+}
+
+func TestDownloadBlockChanged(t *testing.T) {
+	upstream := new(testHydrator)
+	upstream.On("GetObject", "foo", mock.Anything).Return(nil, hydrator.ObjectChanged{Url: "foo"})
+	var changed string
+	ctx := cacheContext{
+		diskCache: &mapDiskCache{blocks: make(map[string][]byte)},
+		hydrator:  upstream,
+		changed: func(url string, key string, size int64) {
+			changed = key
+		},
+	}
+
+	info := dataRequest{
+		MetadataRequest: MetadataRequest{Url: "foo", Key: "key"},
+		Size:            10,
+		BlockSize:       4,
+	}
+	_, err := downloadBlock(ctx, info)
+	assert.Equal(t, hydrator.ObjectChanged{Url: "foo"}, err)
+	assert.Equal(t, "key", changed)
+}
+
+// firstBlockPicker owns the first block of every object and no other key.
+type firstBlockPicker struct{}
+
+func (firstBlockPicker) PickPeer(key string) (groupcache.ProtoGetter, bool) {
+	return nil, !strings.Contains(key, `"Block":0,`)
+}
+
+func TestDownloadBlockFromOwner(t *testing.T) {
+	// The other node owns the first block and downloads the object.
+	upstream := new(testHydrator)
+	upstream.On("GetObject", "foo", mock.Anything).Return(ioutil.NopCloser(bytes.NewReader([]byte("0123456789"))), nil).Once()
+	remote, remoteDisk := newRemoteCache(t, "testdownloadblockfromowner")
+	remote.context = cacheContext{diskCache: remoteDisk, hydrator: upstream}
+	picker := peerPicker
+	peerPicker = firstBlockPicker{}
+	server := httptest.NewServer(downloadHandler(clusterPeers, func(group string) *memoryCache {
+		return remote
+	}))
+	self := clusterPeers.self
+	clusterPeers.Set(server.URL)
+	defer func() {
+		server.Close()
+		clusterPeers.Set(self)
+		peerPicker = picker
+	}()
+
+	diskCache := &mapDiskCache{blocks: make(map[string][]byte)}
+	ctx := cacheContext{
+		diskCache: diskCache,
+		hydrator:  new(testHydrator),
+		groupName: "testdownloadblockfromowner",
+	}
+	cacheEntry := freshEntry()
+	key, err := remote.objectKey("foo", cacheEntry)
+	assert.Nil(t, err)
+	info := dataRequest{
+		MetadataRequest: MetadataRequest{Url: "foo", Key: key, Headers: cacheEntry.Metadata},
+		Block:           1,
+		Size:            10,
+		BlockSize:       4,
+	}
+	data, err := downloadBlock(ctx, info)
+	assert.Nil(t, err)
+	assert.Equal(t, "4567", string(data))
+	assert.Equal(t, map[string][]byte{key + "-1": []byte("4567")}, diskCache.blocks)
+
+	// The owner keeps its own block once the others are read.
+	for i := 0; i < 100 && remoteDisk.len() > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, map[string][]byte{key + "-0": []byte("0123")}, remoteDisk.blocks)
+	upstream.AssertExpectations(t)
+}
+
+func TestRangeUnsupportedRemembered(t *testing.T) {
+	upstream := new(testHydrator)
+	upstream.On("Get", "foo", int64(0), int64(4), mock.Anything).Return(nil, hydrator.RangeNotSupported{Url: "foo"}).Once()
+	upstream.On("GetObject", "foo", mock.Anything).Return(ioutil.NopCloser(bytes.NewReader([]byte("0123456789"))), nil).Once()
+	cache := NewCache(Config{
+		BlockSize:      4,
+		MaxMemoryUsage: 64 * 1024 * 1024,
+		Hydrator:       upstream,
+		DiskCache:      &mapDiskCache{blocks: make(map[string][]byte)},
+		GroupName:      "testrangeunsupportedremembered",
+	})
+	reader, err := cache.Get("foo", &hydrator.CacheEntry{Metadata: map[string]string{"Content-Length": "10", "Etag": `"v1"`}}, nil)
+	assert.Nil(t, err)
+	data := make([]byte, 10)
+	n, err := reader.ReadAt(data, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123456789", string(data[:n]))
+	// Only the first block was requested by range.
+	upstream.AssertExpectations(t)
+}
+
+func TestDownloadBlockOutOfRange(t *testing.T) {
+	ctx := cacheContext{
+		diskCache: &mapDiskCache{blocks: make(map[string][]byte)},
+		hydrator:  new(testHydrator),
+	}
+	info := dataRequest{
+		MetadataRequest: MetadataRequest{Url: "foo", Key: "key"},
+		Block:           2,
+		Size:            8,
+		BlockSize:       4,
+	}
+	// The empty block after an object ending on a block boundary.
+	data, err := downloadBlock(ctx, info)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(data))
+
+	info.Block = 3
+	_, err = downloadLocally(ctx, info)
+	assert.NotNil(t, err)
+}
+
+func TestDownloadHandlerRejects(t *testing.T) {
+	peers := &peerList{self: "http://192.0.2.1:8000"}
+	peers.Set("http://192.0.2.1:8000", "http://192.0.2.2:8000")
+	remote, remoteDisk := newRemoteCache(t, "testdownloadhandlerrejects")
+	remote.context = cacheContext{diskCache: remoteDisk, hydrator: new(testHydrator)}
+	handler := downloadHandler(peers, func(group string) *memoryCache {
+		return remote
+	})
+	cacheEntry := freshEntry()
+	key, err := remote.objectKey("foo", cacheEntry)
+	assert.Nil(t, err)
+	send := func(info dataRequest) int {
+		body, err := json.Marshal(info)
+		assert.Nil(t, err)
+		request := httptest.NewRequest("POST", downloadPath+"?group=testdownloadhandlerrejects", bytes.NewReader(body))
+		request.RemoteAddr = "192.0.2.2:1234"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	valid := dataRequest{
+		MetadataRequest: MetadataRequest{Url: "foo", Key: key, Headers: cacheEntry.Metadata},
+		Block:           1,
+		Size:            10,
+		BlockSize:       4,
+	}
+
+	// None of these start a download, the upstream is never asked.
+	huge := valid
+	huge.Size = 1 << 62
+	assert.Equal(t, http.StatusBadRequest, send(huge))
+	split := valid
+	split.BlockSize = 1
+	assert.Equal(t, http.StatusBadRequest, send(split))
+	outOfRange := valid
+	outOfRange.Block = 3
+	assert.Equal(t, http.StatusBadRequest, send(outOfRange))
+	otherVersion := valid
+	otherVersion.Key = strings.Repeat("ab", 32)
+	assert.Equal(t, http.StatusBadRequest, send(otherVersion))
+}
+
+func TestDownloadFromPeerShortBlock(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "route:a b", r.URL.Query().Get("group"))
+		w.Write([]byte("45"))
+	}))
+	defer server.Close()
+	info := dataRequest{
+		MetadataRequest: MetadataRequest{Url: "foo", Key: "key"},
+		Block:           1,
+		Size:            10,
+		BlockSize:       4,
+	}
+	_, err := downloadFromPeer(server.URL, "route:a b", info)
+	assert.NotNil(t, err)
+}
@@ -3,39 +3,163 @@ package gcache
 import (
 	"encoding/json"
 	"errors"
+	"github.com/fkautz/casserole/cache/diskcache"
+	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/fkautz/casserole/cache/sizereaderat"
 	"github.com/golang/groupcache"
 	"io"
+	"log"
+	"strconv"
 )
 
 type lazyReaderAt struct {
 	request   dataRequest
 	size      int64
 	groupName string
-	ctx       cacheContext
+	trace     *hydrator.Trace
+	onRead    func(block int64, data func() ([]byte, error))
+	// diskCache, when set, serves blocks this node owns straight from
+	// their file instead of through groupcache.
+	diskCache diskcache.Cache
+}
+
+// blockContext is passed through groupcache so the getter and the peer
+// transport can record which tier served a block.
+type blockContext struct {
+	tier string
+}
+
+func (block *blockContext) served(tier string) {
+	if block != nil {
+		block.tier = tier
+	}
 }
 
 func (reader lazyReaderAt) ReadAt(p []byte, offset int64) (int, error) {
 	//key := reader.request.key + "-" + strconv.Itoa(int(reader.request.block))
 
-	jsonDataRequest, err := json.Marshal(reader.request)
+	key, err := reader.key()
 	if err != nil {
 		return 0, err
 	}
-	key := "data/" + string(jsonDataRequest)
-	var byteView groupcache.ByteView
-	err = groupcache.GetGroup(reader.groupName).Get(reader.ctx, key, groupcache.ByteViewSink(&byteView))
+	block := &blockContext{
+		tier: hydrator.TierMemory,
+	}
+	retries := corruptBlocks.get(key)
+	data, err := reader.get(block, retries)
+	if _, ok := err.(diskcache.ChecksumMismatch); ok {
+		log.Println("Checksum mismatch from", block.tier, "refetching", reader.request.Url, reader.request.Block)
+		blockChecksumMismatches.WithLabelValues(reader.groupName, block.tier).Inc()
+		block.tier = hydrator.TierMemory
+		data, err = reader.get(block, corruptBlocks.bump(key, retries))
+	}
 	if err != nil {
 		return 0, err
 	}
-	n := byteView.SliceFrom(int(offset)).Copy(p)
-	//n := copy(p, byteView.ByteSlice()[offset:])
-	return int(n), err
+	reader.trace.AddBlock(reader.request.Block, block.tier)
+	if reader.onRead != nil {
+		reader.onRead(reader.request.Block, func() ([]byte, error) { return data, nil })
+	}
+	if offset >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[offset:])
+	return n, nil
+}
+
+func (reader lazyReaderAt) key() (string, error) {
+	return reader.request.groupKey()
+}
+
+// get reads the block through groupcache under the key for the number of
+// corrupt values it had.
+func (reader lazyReaderAt) get(block *blockContext, retries int64) ([]byte, error) {
+	request := reader.request
+	request.Retry = retries
+	key, err := request.groupKey()
+	if err != nil {
+		return nil, err
+	}
+	var byteView groupcache.ByteView
+	if err := groupcache.GetGroup(reader.groupName).Get(block, key, groupcache.ByteViewSink(&byteView)); err != nil {
+		return nil, err
+	}
+	return openBlock(key, byteView.ByteSlice())
+}
+
+// groupKey returns the groupcache key of a block.
+func (request dataRequest) groupKey() (string, error) {
+	jsonDataRequest, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	return "data/" + string(jsonDataRequest), nil
 }
 
 func (reader lazyReaderAt) Size() int64 {
 	return reader.size
 }
 
+// WriteRangeTo writes part of the block to w. Blocks this node owns that
+// are on disk are copied from their file, so a http.ResponseWriter can
+// send them with sendfile, bypassing the memory tier. Other blocks are read
+// through groupcache.
+func (reader lazyReaderAt) WriteRangeTo(w io.Writer, offset, length int64) (int64, error) {
+	if n, ok, err := reader.writeFromDisk(w, offset, length); ok {
+		return n, err
+	}
+	buf := make([]byte, length)
+	n, err := reader.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	written, err := w.Write(buf[:n])
+	if err == nil && int64(written) < length {
+		err = io.ErrUnexpectedEOF
+	}
+	return int64(written), err
+}
+
+// writeFromDisk copies a block from its file if this node owns the block
+// and has it on disk. It returns false when the block must be read through
+// groupcache instead.
+func (reader lazyReaderAt) writeFromDisk(w io.Writer, offset, length int64) (int64, bool, error) {
+	if reader.diskCache == nil {
+		return 0, false, nil
+	}
+	key, err := reader.key()
+	if err != nil || !ownedLocally(key) {
+		return 0, false, nil
+	}
+	file, err := reader.diskCache.GetFile(reader.request.Key + "-" + strconv.FormatInt(reader.request.Block, 10))
+	if err != nil {
+		return 0, false, nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.Size() != reader.size {
+		return 0, false, nil
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, false, nil
+	}
+	countTier(reader.groupName, "disk", true)
+	reader.trace.AddBlock(reader.request.Block, hydrator.TierDisk)
+	n, err := io.Copy(w, &io.LimitedReader{R: file, N: length})
+	if err == nil && n < length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && reader.onRead != nil {
+		// read back from the open file only when the block is hashed
+		reader.onRead(reader.request.Block, func() ([]byte, error) {
+			data := make([]byte, reader.size)
+			_, err := file.ReadAt(data, 0)
+			return data, err
+		})
+	}
+	return n, true, err
+}
+
 func NewLazyReader(reader io.ReaderAt, start, end, blockSize int64) io.ReadSeeker {
 	return &lazyReadSeeker{
 		base:      reader,
@@ -86,11 +210,17 @@ func (reader *lazyReadSeeker) Size() int64 {
 }
 
 func (reader *lazyReadSeeker) WriteTo(w io.Writer) (int64, error) {
+	if ranged, ok := reader.base.(sizereaderat.RangeWriterTo); ok {
+		n, err := ranged.WriteRangeTo(w, reader.pos, reader.end-reader.pos)
+		reader.pos += n
+		return n, err
+	}
 	var count int64 = 0
 	for reader.pos < reader.end {
 		var buf []byte
-		curBlockSize := reader.blockSize
-		if reader.end-reader.pos < reader.blockSize {
+		// read up to the next block boundary so each read touches one block
+		curBlockSize := reader.blockSize - reader.pos%reader.blockSize
+		if reader.end-reader.pos < curBlockSize {
 			curBlockSize = reader.end - reader.pos
 		}
 		buf = make([]byte, curBlockSize, curBlockSize)
@@ -105,5 +235,5 @@ func (reader *lazyReadSeeker) WriteTo(w io.Writer) (int64, error) {
 			return count, err
 		}
 	}
-	return int64(count), io.EOF
+	return int64(count), nil
 }
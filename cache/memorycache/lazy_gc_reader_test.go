@@ -1,8 +1,13 @@
 package gcache
 
 import (
+	"bytes"
+	"github.com/fkautz/casserole/cache/diskcache"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"io"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -13,6 +18,40 @@ func TestLazyReader(t *testing.T) {
 	mock.AssertExpectations(t)
 }
 
+func TestWriteRangeFromDisk(t *testing.T) {
+	root, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	disk, err := diskcache.New(root, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Shutdown()
+	assert.Nil(t, disk.Put("key-0", bytes.NewReader([]byte("hello"))))
+
+	var reads []int64
+	var contents []byte
+	reader := lazyReaderAt{
+		request:   dataRequest{MetadataRequest: MetadataRequest{Key: "key"}, BlockSize: 5, Size: 5},
+		size:      5,
+		groupName: "test",
+		onRead: func(block int64, data func() ([]byte, error)) {
+			reads = append(reads, block)
+			contents, _ = data()
+		},
+		diskCache: disk,
+	}
+	var buf bytes.Buffer
+	n, err := reader.WriteRangeTo(&buf, 1, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, "ell", buf.String())
+	assert.Equal(t, []int64{0}, reads)
+	assert.Equal(t, "hello", string(contents), "the whole block")
+}
+
 type MockSomething struct {
 	mock.Mock
 }
@@ -7,13 +7,14 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"github.com/coreos/etcd/client"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/fkautz/casserole/cache/diskcache"
 	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/fkautz/casserole/cache/membership"
 	"github.com/fkautz/casserole/cache/sizereaderat"
-	"github.com/fkautz/peertracker"
 	"github.com/golang/groupcache"
+	"github.com/golang/groupcache/lru"
+	"github.com/pquerna/cachecontrol/cacheobject"
 	"io"
 	"io/ioutil"
 	"log"
@@ -26,9 +27,19 @@ import (
 )
 
 type MetadataRequest struct {
-	Url     string
-	Key     string
+	Url string
+	Key string
+	// Headers is the metadata of the object. On a lookup, it is that of
+	// the expired entry to revalidate.
 	Headers map[string]string
+	// Epoch is the minute of a lookup. A lookup stays fresh for at least
+	// minFreshness, so one cached by groupcache is not served expired.
+	Epoch int64 `json:",omitempty"`
+	// Changed is the key of a version a previous lookup of Url returned
+	// that has since changed upstream, so it is not served again.
+	Changed string `json:",omitempty"`
+	// Generation is the generation of the group, raised by purges.
+	Generation int64 `json:",omitempty"`
 }
 
 type dataRequest struct {
@@ -36,23 +47,53 @@ type dataRequest struct {
 	Block     int64
 	Size      int64
 	BlockSize int64
+	// Expires is when the object expires, in unix seconds, so the node
+	// storing a block knows it without its metadata.
+	Expires int64 `json:",omitempty"`
+	// Retry counts the corrupt values read for the block, see
+	// corruptBlocks.
+	Retry int64 `json:",omitempty"`
 }
 
 type cacheContext struct {
 	diskCache diskcache.Cache
 	hydrator  hydrator.Hydrator
+	groupName string
+	block     *blockContext
+	// changed is called when upstream no longer serves the version of an
+	// object being fetched.
+	changed func(url string, key string, size int64)
 }
 
 type memoryCache struct {
 	group            *groupcache.Group
+	getter           groupcache.Getter
+	context          cacheContext
+	verifier         *objectVerifier
 	diskCache        diskcache.Cache
 	hydrator         hydrator.Hydrator
 	blockSize        int64
 	groupName        string
 	metadata         MetadataCache
 	passthroughRegex *regexp.Regexp
+	staleIfError     time.Duration
+	directDiskReads  bool
+	now              func() time.Time
+
+	staleLock    sync.Mutex
+	revalidating map[string]bool
+	// unreachable holds the urls whose last revalidation failed, the
+	// least recently failed are forgotten first.
+	unreachable *lru.Cache
 }
 
+// maxUnreachable bounds the urls remembered as failing upstream.
+const maxUnreachable = 10000
+
+// minFreshness is how long cacheable metadata must stay fresh, and the
+// length of a lookup epoch.
+const minFreshness = 60 * time.Second
+
 type Config struct {
 	MaxMemoryUsage int64
 	BlockSize      int64
@@ -60,8 +101,33 @@ type Config struct {
 	Hydrator       hydrator.Hydrator
 	GroupName      string
 	PeeringAddress string
+	Membership     membership.Membership
 	Etcd           []string
-	PassThrough    []string
+	// EtcdPrefix is the etcd keyspace of the cluster's metadata. Defaults
+	// to /casserole/default/metadata/.
+	EtcdPrefix  string
+	PassThrough []string
+
+	// MetadataRetention is how long metadata is kept after it expires so that
+	// it can be revalidated instead of refetched. Defaults to 24 hours.
+	MetadataRetention time.Duration
+
+	// MaxMetadataEntries bounds the metadata kept on this node, evicting the
+	// least recently used entries. Zero means unbounded.
+	MaxMetadataEntries int
+
+	// StaleIfError is how long past expiration an entry may be served when
+	// upstream is failing and the response carried no stale-if-error
+	// directive of its own.
+	StaleIfError time.Duration
+
+	// DirectDiskReads serves blocks this node owns straight from their file
+	// on disk, e.g. with sendfile, rather than through the memory tier.
+	DirectDiskReads bool
+
+	// PeerSecret, when set, authenticates invalidations between nodes.
+	// Without it, they are only accepted from the addresses of peers.
+	PeerSecret string
 }
 
 type NotCacheable struct{}
@@ -157,7 +223,59 @@ func GenerateKey(url string, headers map[string]string) ([]byte, error) {
 
 	return shasum[:], nil
 }
-func (mc *memoryCache) GetMetadata(url string, clientHeaders http.Header) (*hydrator.CacheEntry, error) {
+func (mc *memoryCache) GetMetadata(url string, clientHeaders http.Header, trace *hydrator.Trace) (*hydrator.CacheEntry, error) {
+	cacheEntry, err := mc.getMetadata(url, clientHeaders, trace)
+	if err == nil && mc.isUntrusted(url, cacheEntry) {
+		return nil, NotCacheable{}
+	}
+	return cacheEntry, err
+}
+
+// isUntrusted reports whether this version of an object failed
+// verification against its digest.
+func (mc *memoryCache) isUntrusted(url string, cacheEntry *hydrator.CacheEntry) bool {
+	key, err := mc.objectKey(url, cacheEntry)
+	if err != nil {
+		return false
+	}
+	return untrustedVersions.contains(key)
+}
+
+// objectKey returns the key of the blocks of this version of an object.
+func (mc *memoryCache) objectKey(url string, cacheEntry *hydrator.CacheEntry) (string, error) {
+	sum, err := GenerateKey(mc.namespace(url), cacheEntry.Metadata)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// objectChanged drops a version of an object that upstream no longer
+// serves on every node: its metadata, if still current, and every block
+// fetched so far, so it is never served mixed with blocks of the new
+// version. Each block fetch of the version fails the same way, only the
+// first drops it.
+func (mc *memoryCache) objectChanged(url string, key string, size int64) {
+	if !mc.verifier.markChanged(key) {
+		return
+	}
+	log.Println("Object changed upstream, invalidating", url)
+	mc.dropVersion(objectVersion{Url: url, Key: key, Size: size})
+}
+
+// dropVersion drops a version of an object on every node.
+func (mc *memoryCache) dropVersion(version objectVersion) {
+	message := invalidation{
+		Group:   mc.groupName,
+		Version: &version,
+	}
+	mc.invalidate(message, true)
+	if _, err := broadcast(message); err != nil {
+		log.Println("Unable to invalidate", version.Url, err)
+	}
+}
+
+func (mc *memoryCache) getMetadata(url string, clientHeaders http.Header, trace *hydrator.Trace) (*hydrator.CacheEntry, error) {
 
 	if mc.passthroughRegex != nil {
 		if mc.passthroughRegex.MatchString(url) {
@@ -166,62 +284,273 @@ func (mc *memoryCache) GetMetadata(url string, clientHeaders http.Header) (*hydr
 	}
 
 	var cacheEntry *hydrator.CacheEntry
-	cacheEntry, foundMetadata := mc.metadata.Get(url, clientHeaders)
-
-	var err error
+	cacheEntry, foundMetadata := mc.metadata.Get(mc.namespace(url), clientHeaders)
+	fresh := foundMetadata && cacheEntry.ObjectResults.OutExpirationTime.After(mc.now())
+	countTier(mc.groupName, "metadata", fresh)
 	if !foundMetadata {
-		cacheEntry, err = mc.hydrator.GetMetadata(url)
+		trace.SetMetadata(hydrator.MetadataMiss)
+		cacheEntry, err := mc.lookupMetadata(url, nil)
 		if err != nil {
 			return nil, err
 		}
+		return mc.admit(url, cacheEntry)
+	}
 
-		if len(cacheEntry.ObjectResults.OutReasons) > 0 {
-			return nil, NotCacheable{}
-		}
+	staleness := mc.now().Sub(cacheEntry.ObjectResults.OutExpirationTime)
+	if staleness < 0 {
+		trace.SetMetadata(hydrator.MetadataHit)
+		return cacheEntry, nil
+	}
 
-		//now := time.Now()
-		//exp := cacheEntry.ObjectResults.OutExpirationTime
-		//log.Println("Now:", now)
-		//log.Println("Exp:", exp)
-		if cacheEntry.ObjectResults.OutExpirationTime.Before(time.Now().Add(60 * time.Second)) {
-			//log.Println("SKIP")
-			return nil, NotCacheable{}
-		} else if v, ok := cacheEntry.Metadata["Accept-Ranges"]; ok == true {
-			if strings.ToLower(string(v[0])) == "none" {
-				return nil, NotCacheable{}
-			}
-		} else {
-			//log.Println("CACHE")
-		}
+	// Expired entries are kept around so they can be revalidated. An
+	// unchanged object keeps its key, and with it its disk blocks.
+	directives := mc.staleDirectives(cacheEntry)
+	if staleness < directives.whileRevalidate {
+		go mc.revalidateInBackground(url, cacheEntry)
+		trace.SetMetadata(hydrator.MetadataStaleWhileRevalidate)
+		return stale(cacheEntry, `110 - "Response is Stale"`), nil
+	}
+	if staleness < directives.ifError && mc.isUnreachable(url) {
+		go mc.revalidateInBackground(url, cacheEntry)
+		trace.SetMetadata(hydrator.MetadataStaleIfError)
+		return stale(cacheEntry, `111 - "Revalidation Failed"`), nil
+	}
 
-		if err := mc.metadata.Add(url, *cacheEntry); err != nil {
+	revalidated, err := mc.revalidate(url, cacheEntry)
+	if err != nil && staleness < directives.ifError && isUpstreamFailure(err) {
+		log.Println("Serving stale", url, err)
+		trace.SetMetadata(hydrator.MetadataStaleIfError)
+		return stale(cacheEntry, `111 - "Revalidation Failed"`), nil
+	}
+	trace.SetMetadata(hydrator.MetadataRevalidated)
+	return revalidated, err
+}
+
+// lookupMetadata fetches metadata through the peer owning the url, or
+// revalidates an expired entry through it, so the cluster sends one HEAD
+// upstream per url and minute however many nodes miss at once. Lookups are
+// cached by groupcache for the minute, one whose object has changed
+// upstream since is repeated under a new key.
+func (mc *memoryCache) lookupMetadata(url string, expired *hydrator.CacheEntry) (*hydrator.CacheEntry, error) {
+	request := MetadataRequest{
+		Url:        url,
+		Generation: generation(mc.groupName),
+		Epoch:      mc.now().Unix() / int64(minFreshness/time.Second),
+	}
+	if expired != nil {
+		request.Headers = expired.Metadata
+	}
+	for {
+		cacheEntry, err := mc.getLookup(request, mc.group)
+		if err != nil {
 			return nil, err
 		}
+		key, err := mc.objectKey(url, cacheEntry)
+		if err != nil {
+			return nil, err
+		}
+		if mc.verifier.isChanged(key) && request.Changed != key {
+			request.Changed = key
+			request.Headers = nil
+			continue
+		}
+		if cacheEntry.ObjectResults.OutExpirationTime.After(mc.now()) || request.Changed == key {
+			return cacheEntry, nil
+		}
+		// The clock of the node that looked it up is behind, look it up
+		// again on this node.
+		return mc.getLookup(request, mc.getter)
+	}
+}
+
+// getLookup runs a metadata lookup through getter, groupcache or the
+// getter of this node.
+func (mc *memoryCache) getLookup(request MetadataRequest, getter groupcache.Getter) (*hydrator.CacheEntry, error) {
+	js, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if err := getter.Get(nil, "metadata/"+string(js), groupcache.AllocatingByteSliceSink(&data)); err != nil {
+		return nil, err
+	}
+	cacheEntry := &hydrator.CacheEntry{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(cacheEntry); err != nil {
+		return nil, err
 	}
 	return cacheEntry, nil
 }
 
-func (mc *memoryCache) Get(url string, cacheEntry *hydrator.CacheEntry) (sizereaderat.SizeReaderAt, error) {
+// admit checks that a fresh cache entry may be cached and shares it with the
+// cluster.
+func (mc *memoryCache) admit(url string, cacheEntry *hydrator.CacheEntry) (*hydrator.CacheEntry, error) {
+	if err := checkCacheable(cacheEntry); err != nil {
+		return nil, err
+	}
+	if err := mc.metadata.Add(mc.namespace(url), *cacheEntry); err != nil {
+		return nil, err
+	}
+	return cacheEntry, nil
+}
+
+// checkCacheable returns NotCacheable for entries that must not be cached.
+func checkCacheable(cacheEntry *hydrator.CacheEntry) error {
+	if len(cacheEntry.ObjectResults.OutReasons) > 0 {
+		return NotCacheable{}
+	}
+
+	//now := time.Now()
+	//exp := cacheEntry.ObjectResults.OutExpirationTime
+	//log.Println("Now:", now)
+	//log.Println("Exp:", exp)
+	if cacheEntry.ObjectResults.OutExpirationTime.Before(time.Now().Add(minFreshness)) {
+		//log.Println("SKIP")
+		return NotCacheable{}
+	} else if v, ok := cacheEntry.Metadata["Accept-Ranges"]; ok == true {
+		if strings.ToLower(string(v[0])) == "none" {
+			return NotCacheable{}
+		}
+	} else {
+		//log.Println("CACHE")
+	}
+	return nil
+}
+
+// revalidate revalidates an expired entry through the peer owning the url.
+// Groupcache falls back to this node when the peer fails, so upstream
+// errors are those of this node.
+func (mc *memoryCache) revalidate(url string, cacheEntry *hydrator.CacheEntry) (*hydrator.CacheEntry, error) {
+	revalidated, err := mc.lookupMetadata(url, cacheEntry)
+	mc.staleLock.Lock()
+	if err != nil && isUpstreamFailure(err) {
+		mc.unreachable.Add(url, true)
+	} else {
+		mc.unreachable.Remove(url)
+	}
+	mc.staleLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return mc.admit(url, revalidated)
+}
+
+// revalidateInBackground refreshes a stale entry while it is being served,
+// at most once at a time per url.
+func (mc *memoryCache) revalidateInBackground(url string, cacheEntry *hydrator.CacheEntry) {
+	mc.staleLock.Lock()
+	if mc.revalidating[url] {
+		mc.staleLock.Unlock()
+		return
+	}
+	mc.revalidating[url] = true
+	mc.staleLock.Unlock()
+
+	if _, err := mc.revalidate(url, cacheEntry); err != nil {
+		log.Println("Background revalidation failed", url, err)
+	}
+
+	mc.staleLock.Lock()
+	delete(mc.revalidating, url)
+	mc.staleLock.Unlock()
+}
+
+func (mc *memoryCache) isUnreachable(url string) bool {
+	mc.staleLock.Lock()
+	defer mc.staleLock.Unlock()
+	_, ok := mc.unreachable.Get(url)
+	return ok
+}
+
+type staleWindows struct {
+	whileRevalidate time.Duration
+	ifError         time.Duration
+}
+
+// staleDirectives returns how long past expiration an entry may be served
+// according to RFC 5861. Entries that must be revalidated are never stale.
+func (mc *memoryCache) staleDirectives(cacheEntry *hydrator.CacheEntry) staleWindows {
+	directives, err := cacheobject.ParseResponseCacheControl(cacheEntry.Metadata["Cache-Control"])
+	if err == nil && (directives.MustRevalidate || directives.ProxyRevalidate) {
+		return staleWindows{}
+	}
+	windows := staleWindows{
+		ifError: mc.staleIfError,
+	}
+	if err != nil {
+		return windows
+	}
+	if directives.StaleWhileRevalidate > 0 {
+		windows.whileRevalidate = time.Duration(directives.StaleWhileRevalidate) * time.Second
+	}
+	if directives.StaleIfError >= 0 {
+		windows.ifError = time.Duration(directives.StaleIfError) * time.Second
+	}
+	return windows
+}
+
+// isUpstreamFailure reports whether err means upstream could not answer,
+// as opposed to answering that the object is gone or not cacheable.
+func isUpstreamFailure(err error) bool {
+	switch typedErr := err.(type) {
+	case NotCacheable:
+		return false
+	case hydrator.UnexpectedStatus:
+		return typedErr.StatusCode >= 500
+	default:
+		return true
+	}
+}
+
+// stale returns a copy of cacheEntry marked as served stale.
+func stale(cacheEntry *hydrator.CacheEntry, warning string) *hydrator.CacheEntry {
+	metadata := make(map[string]string)
+	for k, v := range cacheEntry.Metadata {
+		metadata[k] = v
+	}
+	metadata["Warning"] = warning
+	return &hydrator.CacheEntry{
+		ObjectResults: cacheEntry.ObjectResults,
+		Metadata:      metadata,
+	}
+}
+
+func (mc *memoryCache) Get(url string, cacheEntry *hydrator.CacheEntry, trace *hydrator.Trace) (sizereaderat.SizeReaderAt, error) {
 
 	// Just passing headers in naively
-	sum, err := GenerateKey(url, cacheEntry.Metadata)
+	sum, err := GenerateKey(mc.namespace(url), cacheEntry.Metadata)
 	key := hex.EncodeToString(sum[:])
 	metadataRequest := MetadataRequest{
-		Url:     url,
-		Key:     key,
-		Headers: cacheEntry.Metadata,
-	}
-
-	ctx := cacheContext{
-		diskCache: mc.diskCache,
-		hydrator:  mc.hydrator,
+		Url:        url,
+		Key:        key,
+		Headers:    cacheEntry.Metadata,
+		Generation: generation(mc.groupName),
 	}
 
 	totalSize, err := strconv.ParseInt(cacheEntry.Metadata["Content-Length"], 10, 64)
 	if err != nil {
 		return nil, err
 	}
+	var expires int64
+	if cacheEntry.ObjectResults != nil && !cacheEntry.ObjectResults.OutExpirationTime.IsZero() {
+		expires = cacheEntry.ObjectResults.OutExpirationTime.Unix()
+	}
 
+	var onRead func(block int64, data func() ([]byte, error))
+	if digests := parseDigests(cacheEntry.Metadata); len(digests) > 0 && totalSize > 0 {
+		blockCount := (totalSize + mc.blockSize - 1) / mc.blockSize
+		onRead = func(block int64, data func() ([]byte, error)) {
+			if done, ok := mc.verifier.blockRead(key, block, blockCount, digests, data); done {
+				go mc.verified(url, key, totalSize, ok)
+			}
+		}
+	}
+	return mc.newReader(metadataRequest, totalSize, expires, trace, onRead), nil
+}
+
+// newReader reads an object expiring at expires block by block through
+// groupcache, calling onRead, if set, with each block read and a function
+// returning its contents.
+func (mc *memoryCache) newReader(metadataRequest MetadataRequest, totalSize int64, expires int64, trace *hydrator.Trace, onRead func(block int64, data func() ([]byte, error))) sizereaderat.SizeReaderAt {
 	// TODO blockCount
 	blockCount := int(totalSize/mc.blockSize + 1)
 
@@ -233,6 +562,7 @@ func (mc *memoryCache) Get(url string, cacheEntry *hydrator.CacheEntry) (sizerea
 			Block:           int64(i),
 			Size:            totalSize,
 			BlockSize:       mc.blockSize,
+			Expires:         expires,
 		}
 		partSize := mc.blockSize
 		if sizeLeft < partSize {
@@ -242,7 +572,11 @@ func (mc *memoryCache) Get(url string, cacheEntry *hydrator.CacheEntry) (sizerea
 			request:   request,
 			size:      partSize,
 			groupName: mc.groupName,
-			ctx:       ctx,
+			trace:     trace,
+			onRead:    onRead,
+		}
+		if mc.directDiskReads {
+			part.diskCache = mc.diskCache
 		}
 		sizeLeft = sizeLeft - part.size
 		//go part.ReadAt(make([]byte, 1), 0) // Preload cache
@@ -251,11 +585,17 @@ func (mc *memoryCache) Get(url string, cacheEntry *hydrator.CacheEntry) (sizerea
 
 	unalignedReader := sizereaderat.NewMultiReaderAt(parts...)
 	//alignedReader := sizereaderat.NewChunkAlignedReaderAt(unalignedReader, int(mc.blockSize))
-	return unalignedReader, nil
+	return unalignedReader
+}
+
+func (mc *memoryCache) Forward(url string, request *http.Request) (*http.Response, error) {
+	return mc.hydrator.Forward(url, request)
 }
 
-func (mc *memoryCache) ForceGet(url string) (resp *http.Response, err error) {
-	return mc.hydrator.ForceGet(url)
+// namespace scopes a url to this cache's group so that several caches, each
+// fronting a different upstream, never share metadata or disk keys.
+func (mc *memoryCache) namespace(url string) string {
+	return mc.groupName + "/" + url
 }
 
 func (mc *memoryCache) getRange(url string, offset int64, length int64) (io.ReaderAt, error) {
@@ -264,6 +604,18 @@ func (mc *memoryCache) getRange(url string, offset int64, length int64) (io.Read
 
 var setupPool = sync.Once{}
 
+// peerPicker is the groupcache pool, it picks the node owning a key.
+var peerPicker groupcache.PeerPicker
+
+// ownedLocally reports whether this node owns a groupcache key.
+func ownedLocally(key string) bool {
+	if peerPicker == nil {
+		return true
+	}
+	_, remote := peerPicker.PickPeer(key)
+	return !remote
+}
+
 func NewCache(config Config) hydrator.Cache {
 	setupPool.Do(func() {
 		me := "http://127.0.0.1:8000"
@@ -273,28 +625,36 @@ func NewCache(config Config) hydrator.Cache {
 		}
 		addr := regex.ReplaceAllString(me, "")
 		peers := groupcache.NewHTTPPool(me)
-		peers.Context = func(req *http.Request) groupcache.Context {
-			return cacheContext{
-				diskCache: config.DiskCache,
-				hydrator:  config.Hydrator,
+		peerPicker = peers
+		peers.Transport = func(ctx groupcache.Context) http.RoundTripper {
+			if block, ok := ctx.(*blockContext); ok {
+				block.served(hydrator.TierPeer)
 			}
+			return http.DefaultTransport
 		}
-		etcdConfig := client.Config{
-			Endpoints: config.Etcd,
-			//Transport:               client.DefaultTransport,
-			//HeaderTimeoutPerRequest: time.Second,
+		if config.Membership == nil {
+			config.Membership = membership.Standalone{}
 		}
-		etcdClient, err := client.New(etcdConfig)
-		if err != nil {
-			log.Fatalln("Could not connect to etcd")
-		}
-		time.Sleep(2 * time.Second)
-		peertracker.NewPeerTracker(etcdClient, me, "/casserole/peers", 60*time.Second, func(newPeers []string) {
+		clusterPeers.self = me
+		peerSecret = config.PeerSecret
+		err := config.Membership.Watch(me, func(newPeers []string) {
 			log.Println("Settings peers:", newPeers)
 			peers.Set(newPeers...)
+			for _, peer := range clusterPeers.Set(newPeers...) {
+				go pullState(peer)
+			}
 		})
+		if err != nil {
+			log.Fatalln("Could not join cluster", err)
+		}
+		if _, standalone := config.Membership.(membership.Standalone); standalone {
+			return
+		}
 		go func() {
-			handler := peers
+			handler := http.NewServeMux()
+			handler.Handle("/", peers)
+			handler.Handle(invalidatePath, invalidateHandler(clusterPeers, lookupGroup))
+			handler.Handle(downloadPath, downloadHandler(clusterPeers, lookupGroup))
 			//handler = handlers.LoggingHandler(os.Stderr, peers)
 			if err := http.ListenAndServe(addr, handler); err != nil {
 				log.Panicln(err)
@@ -306,19 +666,47 @@ func NewCache(config Config) hydrator.Cache {
 		config.GroupName = "default"
 	}
 
-	group := groupcache.NewGroup(config.GroupName, config.MaxMemoryUsage, groupcache.GetterFunc(getterFunc))
-
-	etcdConfig := clientv3.Config{
-		Endpoints: config.Etcd,
+	// Each group carries its own context so peers hydrate from the upstream
+	// that owns the group rather than whichever cache was created first.
+	var mc *memoryCache
+	ctx := cacheContext{
+		diskCache: config.DiskCache,
+		hydrator:  config.Hydrator,
+		groupName: config.GroupName,
+		changed: func(url string, key string, size int64) {
+			mc.objectChanged(url, key, size)
+		},
 	}
+	getter := groupcache.GetterFunc(func(gctx groupcache.Context, key string, dest groupcache.Sink) error {
+		blockCtx := ctx
+		blockCtx.block, _ = gctx.(*blockContext)
+		return getterFunc(blockCtx, key, dest)
+	})
+	group := groupcache.NewGroup(config.GroupName, config.MaxMemoryUsage, getter)
 
-	etcdClientV3, err := clientv3.New(etcdConfig)
-	if err != nil {
-		log.Panicln(err)
+	if config.MetadataRetention == 0 {
+		config.MetadataRetention = 24 * time.Hour
 	}
 
-	mdCache := NewMetadataCache()
-	NewMetadataSyncer(mdCache, etcdClientV3)
+	// Without etcd, metadata stays local to this node.
+	mdCache := NewMetadataCache(config.MetadataRetention, config.MaxMetadataEntries)
+	if len(config.Etcd) > 0 {
+		etcdConfig := clientv3.Config{
+			Endpoints: config.Etcd,
+		}
+
+		etcdClientV3, err := clientv3.New(etcdConfig)
+		if err != nil {
+			log.Panicln(err)
+		}
+		if config.EtcdPrefix == "" {
+			config.EtcdPrefix = "/casserole/default/metadata/"
+		}
+		// Only this group's keys, see namespace.
+		NewMetadataSyncer(mdCache, etcdClientV3, config.EtcdPrefix, config.GroupName+"/", config.MetadataRetention)
+	} else {
+		mdCache.AddSync(localSync{})
+	}
 	log.Println("Passthrough:")
 
 	var passthroughRegex *regexp.Regexp
@@ -327,20 +715,35 @@ func NewCache(config Config) hydrator.Cache {
 		passthroughRegex = regexp.MustCompile(passThroughRegexString)
 	}
 
-	mc := &memoryCache{
+	mc = &memoryCache{
 		group:            group,
+		getter:           getter,
+		context:          ctx,
+		verifier:         newObjectVerifier(),
 		diskCache:        config.DiskCache,
 		hydrator:         config.Hydrator,
 		blockSize:        config.BlockSize,
 		groupName:        config.GroupName,
 		metadata:         mdCache,
 		passthroughRegex: passthroughRegex,
+		staleIfError:     config.StaleIfError,
+		directDiskReads:  config.DirectDiskReads && config.DiskCache != nil,
+		now:              time.Now,
+		revalidating:     make(map[string]bool),
+		unreachable:      lru.New(maxUnreachable),
 	}
+	collector.add(mc)
+	registerGroup(mc)
 
 	return mc
 }
 
-type mcContext struct{}
+// expireBlock tells the disk cache when the object of a block expires.
+func expireBlock(ctx cacheContext, diskKey string, info dataRequest) {
+	if info.Expires != 0 {
+		ctx.diskCache.Expires(diskKey, time.Unix(info.Expires, 0))
+	}
+}
 
 func getterFunc(ctx groupcache.Context, key string, dest groupcache.Sink) error {
 	typedCtx := ctx.(cacheContext)
@@ -354,10 +757,19 @@ func getterFunc(ctx groupcache.Context, key string, dest groupcache.Sink) error
 		if err != nil {
 			return err
 		}
-		cacheEntry, err := typedCtx.hydrator.GetMetadata(info.Url)
+		var cacheEntry *hydrator.CacheEntry
+		if info.Headers != nil {
+			cacheEntry, err = typedCtx.hydrator.Revalidate(info.Url, &hydrator.CacheEntry{Metadata: info.Headers})
+		} else {
+			cacheEntry, err = typedCtx.hydrator.GetMetadata(info.Url)
+		}
 		if err != nil {
 			return err
 		}
+		// Errors are not kept by groupcache, entries are until evicted.
+		if err := checkCacheable(cacheEntry); err != nil {
+			return err
+		}
 		var buf bytes.Buffer
 		encoder := gob.NewEncoder(&buf)
 		encoder.Encode(cacheEntry)
@@ -380,21 +792,47 @@ func getterFunc(ctx groupcache.Context, key string, dest groupcache.Sink) error
 		if err == nil {
 			data, err := ioutil.ReadAll(reader)
 			if err == nil {
-				dest.SetBytes(data)
+				expireBlock(typedCtx, diskKey, info)
+				countTier(typedCtx.groupName, "disk", true)
+				typedCtx.block.served(hydrator.TierDisk)
+				dest.SetBytes(sealBlock(data))
 				return nil
 			}
 		}
+		countTier(typedCtx.groupName, "disk", false)
 
 		// if not on disk, hydrate from upstream and store to disk
-		data, err := typedCtx.hydrator.Get(info.Url, start, end)
-		if err != nil {
-			return err
+		typedCtx.block.served(hydrator.TierOrigin)
+		var data []byte
+		if rangeUnsupported.contains(info.Key) {
+			err = hydrator.RangeNotSupported{Url: info.Url}
+		} else {
+			data, err = typedCtx.hydrator.Get(info.Url, start, end, &hydrator.CacheEntry{Metadata: info.Headers})
+		}
+		if _, ok := err.(hydrator.ObjectChanged); ok && typedCtx.changed != nil {
+			typedCtx.changed(info.Url, info.Key, info.Size)
+		}
+		if _, ok := err.(hydrator.RangeNotSupported); ok {
+			rangeUnsupported.add(info.Key)
+			// downloadBlock stores the block on disk itself
+			data, err = downloadBlock(typedCtx, info)
+			if err != nil {
+				return err
+			}
+			dest.SetBytes(sealBlock(data))
+			return nil
 		}
-		err = typedCtx.diskCache.Put(diskKey, bytes.NewBuffer(data))
 		if err != nil {
 			return err
 		}
-		dest.SetBytes(data)
+		if typedCtx.diskCache.Admit(diskKey, int64(len(data))) {
+			err = typedCtx.diskCache.Put(diskKey, bytes.NewBuffer(data))
+			if err != nil {
+				return err
+			}
+			expireBlock(typedCtx, diskKey, info)
+		}
+		dest.SetBytes(sealBlock(data))
 		return nil
 	} else {
 		return errors.New("Unknown type request")
@@ -3,11 +3,23 @@ package gcache
 import (
 	"bytes"
 	"errors"
+	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/fkautz/casserole/cache/router"
+	"github.com/golang/groupcache"
+	"github.com/golang/groupcache/groupcachepb"
+	"github.com/golang/protobuf/proto"
+	"github.com/pquerna/cachecontrol/cacheobject"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testHydrator struct {
@@ -19,63 +31,64 @@ type testDiskCache struct {
 }
 
 func TestDiskCacheAccess(t *testing.T) {
-	hydrator := new(testHydrator)
+	upstream := new(testHydrator)
 	diskCache := new(testDiskCache)
 
-	diskCache.On("Get", "foo").Return(ioutil.NopCloser(bytes.NewBuffer(make([]byte, 2048, 2048))), nil)
-	//hydrator.On("Get", "foo").Return(make([]byte, 2048, 2048), nil)
+	diskCache.On("Get", mock.AnythingOfType("string")).Return(ioutil.NopCloser(bytes.NewBuffer(make([]byte, 2048, 2048))), nil)
+	//upstream.On("Get", "foo").Return(make([]byte, 2048, 2048), nil)
 
 	config := Config{
 		BlockSize:      int64(1 * 1024 * 1024),
 		MaxMemoryUsage: 64 * 1024 * 1024,
-		Hydrator:       hydrator,
+		Hydrator:       upstream,
 		DiskCache:      diskCache,
 		GroupName:      "testdiskcache",
 	}
 
 	cache := NewCache(config)
-	reader, err := cache.Get("foo", make(map[string]string))
+	reader, err := cache.Get("foo", &hydrator.CacheEntry{Metadata: map[string]string{"Content-Length": "2048"}}, nil)
 	if err != nil {
-		t.Fail()
+		t.Fatal(err)
 	}
 	data := make([]byte, 10, 10)
 	length, err := reader.ReadAt(data, 0)
 	assert.Equal(t, 10, length)
 	assert.Equal(t, nil, err)
 	diskCache.AssertExpectations(t)
-	hydrator.AssertExpectations(t)
+	upstream.AssertExpectations(t)
 }
 
 func TestHydratorAccess(t *testing.T) {
-	hydrator := new(testHydrator)
+	upstream := new(testHydrator)
 	diskCache := new(testDiskCache)
 
-	diskCache.On("Get", "foo").Return(nil, errors.New("Not Found"))
-	hydrator.On("Get", "foo", int64(0), int64(1048576)).Return(make([]byte, 10, 10), nil)
-	diskCache.On("Put", "foo", mock.Anything).Return(nil)
+	diskCache.On("Get", mock.AnythingOfType("string")).Return(nil, errors.New("Not Found"))
+	upstream.On("Get", "foo", int64(0), int64(10), mock.Anything).Return(make([]byte, 10, 10), nil)
+	diskCache.On("Admit", mock.AnythingOfType("string"), int64(10)).Return(true)
+	diskCache.On("Put", mock.AnythingOfType("string"), mock.Anything).Return(nil)
 
 	config := Config{
 		BlockSize:      int64(1 * 1024 * 1024),
 		MaxMemoryUsage: 64 * 1024 * 1024,
-		Hydrator:       hydrator,
+		Hydrator:       upstream,
 		DiskCache:      diskCache,
 		GroupName:      "testhydrator",
 	}
 	cache := NewCache(config)
-	reader, err := cache.Get("foo", make(map[string]string))
+	reader, err := cache.Get("foo", &hydrator.CacheEntry{Metadata: map[string]string{"Content-Length": "10"}}, nil)
 	if err != nil {
-		t.Fail()
+		t.Fatal(err)
 	}
 	data := make([]byte, 10, 10)
 	length, err := reader.ReadAt(data, 0)
 	assert.Equal(t, 10, length)
 	assert.Equal(t, nil, err)
 	diskCache.AssertExpectations(t)
-	hydrator.AssertExpectations(t)
+	upstream.AssertExpectations(t)
 }
 
-func (m *testHydrator) Get(url string, offset int64, length int64) ([]byte, error) {
-	args := m.Called(url, offset, length)
+func (m *testHydrator) Get(url string, start int64, end int64, cacheEntry *hydrator.CacheEntry) ([]byte, error) {
+	args := m.Called(url, start, end, cacheEntry)
 	var ret0 []byte = nil
 	if args.Get(0) != nil {
 		ret0 = args.Get(0).([]byte)
@@ -87,9 +100,28 @@ func (m *testHydrator) Get(url string, offset int64, length int64) ([]byte, erro
 	return ret0, ret1
 }
 
-func (m *testHydrator) GetMetadata(url string) (map[string]string, error) {
+func (m *testHydrator) GetMetadata(url string) (*hydrator.CacheEntry, error) {
 	args := m.Called(url)
-	return args.Get(0).(map[string]string), args.Get(1).(error)
+	return args.Get(0).(*hydrator.CacheEntry), args.Error(1)
+}
+
+func (m *testHydrator) GetObject(url string, cacheEntry *hydrator.CacheEntry) (io.ReadCloser, error) {
+	args := m.Called(url, cacheEntry)
+	var ret0 io.ReadCloser
+	if args.Get(0) != nil {
+		ret0 = args.Get(0).(io.ReadCloser)
+	}
+	return ret0, args.Error(1)
+}
+
+func (m *testHydrator) Revalidate(url string, cacheEntry *hydrator.CacheEntry) (*hydrator.CacheEntry, error) {
+	args := m.Called(url, cacheEntry)
+	return args.Get(0).(*hydrator.CacheEntry), args.Error(1)
+}
+
+func (m *testHydrator) Forward(url string, request *http.Request) (*http.Response, error) {
+	args := m.Called(url, request)
+	return args.Get(0).(*http.Response), args.Error(1)
 }
 
 func (m *testDiskCache) Get(url string) (io.ReadCloser, error) {
@@ -125,3 +157,303 @@ func (m *testDiskCache) Shutdown() error {
 	args := m.Called()
 	return args.Get(0).(error)
 }
+
+func (m *testDiskCache) Remove(url string) {
+	m.Called(url)
+}
+
+func (m *testDiskCache) GetFile(url string) (*os.File, error) {
+	args := m.Called(url)
+	return args.Get(0).(*os.File), args.Error(1)
+}
+
+func (m *testDiskCache) Admit(url string, size int64) bool {
+	args := m.Called(url, size)
+	return args.Bool(0)
+}
+
+func (m *testDiskCache) Expires(url string, expires time.Time) {
+	m.Called(url, expires)
+}
+
+func TestMetadataLookupSingleflight(t *testing.T) {
+	upstream := new(testHydrator)
+	fresh := &hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{OutExpirationTime: time.Now().Add(time.Hour)},
+		Metadata:      map[string]string{"Content-Length": "10"},
+	}
+	upstream.On("GetMetadata", "foo").Return(fresh, nil).Once()
+
+	cache := NewCache(Config{
+		BlockSize:      int64(1 * 1024 * 1024),
+		MaxMemoryUsage: 64 * 1024 * 1024,
+		Hydrator:       upstream,
+		GroupName:      "testmetadatalookup",
+	}).(*memoryCache)
+
+	for i := 0; i < 2; i++ {
+		cache.metadata.RemoveWithoutSync(cache.namespace("foo"))
+		cacheEntry, err := cache.GetMetadata("foo", nil, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "10", cacheEntry.Metadata["Content-Length"])
+	}
+	upstream.AssertExpectations(t)
+}
+
+// newStaleCache returns a cache holding an entry for foo that expired a
+// minute ago.
+func newStaleCache(t *testing.T, group string, cacheControl string) (*memoryCache, *testHydrator) {
+	upstream := new(testHydrator)
+	cache := NewCache(Config{
+		BlockSize:      int64(1 * 1024 * 1024),
+		MaxMemoryUsage: 64 * 1024 * 1024,
+		Hydrator:       upstream,
+		GroupName:      group,
+		StaleIfError:   time.Hour,
+	}).(*memoryCache)
+	cache.metadata.AddWithoutSync(cache.namespace("foo"), hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{OutExpirationTime: time.Now().Add(-time.Minute)},
+		Metadata:      map[string]string{"Content-Length": "10", "Cache-Control": cacheControl, "Etag": `"v1"`},
+	})
+	return cache, upstream
+}
+
+func freshEntry() *hydrator.CacheEntry {
+	return &hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{OutExpirationTime: time.Now().Add(time.Hour)},
+		Metadata:      map[string]string{"Content-Length": "10", "Etag": `"v1"`},
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	cache, upstream := newStaleCache(t, "teststaleiferror", "max-age=60")
+	upstream.On("Revalidate", "foo", mock.Anything).Return((*hydrator.CacheEntry)(nil), errors.New("connection refused")).Once()
+
+	trace := hydrator.NewTrace()
+	cacheEntry, err := cache.GetMetadata("foo", nil, trace)
+	assert.Nil(t, err)
+	assert.Equal(t, `111 - "Revalidation Failed"`, cacheEntry.Metadata["Warning"])
+	assert.Equal(t, hydrator.MetadataStaleIfError, trace.Metadata())
+	assert.True(t, cache.isUnreachable("foo"))
+
+	// Later requests do not wait for the failing upstream, the entry is
+	// revalidated in the background.
+	upstream.On("Revalidate", "foo", mock.Anything).Return(freshEntry(), nil).Once()
+	cacheEntry, err = cache.GetMetadata("foo", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `111 - "Revalidation Failed"`, cacheEntry.Metadata["Warning"])
+	for i := 0; i < 100 && cache.isUnreachable("foo"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cacheEntry, err = cache.GetMetadata("foo", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", cacheEntry.Metadata["Warning"])
+	upstream.AssertExpectations(t)
+}
+
+func TestStaleIfErrorStatus(t *testing.T) {
+	cache, upstream := newStaleCache(t, "teststaleiferrorstatus", "max-age=60")
+	upstream.On("Revalidate", "foo", mock.Anything).Return((*hydrator.CacheEntry)(nil), hydrator.UnexpectedStatus{StatusCode: 503}).Once()
+	cacheEntry, err := cache.GetMetadata("foo", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `111 - "Revalidation Failed"`, cacheEntry.Metadata["Warning"])
+
+	// A 404 is an answer, not a failure.
+	cache, upstream = newStaleCache(t, "teststaleiferrornotfound", "max-age=60")
+	upstream.On("Revalidate", "foo", mock.Anything).Return((*hydrator.CacheEntry)(nil), hydrator.UnexpectedStatus{StatusCode: 404}).Once()
+	_, err = cache.GetMetadata("foo", nil, nil)
+	assert.NotNil(t, err)
+	assert.False(t, cache.isUnreachable("foo"))
+
+	cache, upstream = newStaleCache(t, "teststaleiferrormustrevalidate", "max-age=60, must-revalidate")
+	upstream.On("Revalidate", "foo", mock.Anything).Return((*hydrator.CacheEntry)(nil), errors.New("connection refused")).Once()
+	_, err = cache.GetMetadata("foo", nil, nil)
+	assert.NotNil(t, err, "must-revalidate entries are never served stale")
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	cache, upstream := newStaleCache(t, "teststalewhilerevalidate", "max-age=60, stale-while-revalidate=600")
+	revalidating := make(chan time.Time)
+	upstream.On("Revalidate", "foo", mock.Anything).WaitUntil(revalidating).Return(freshEntry(), nil)
+
+	// Served stale at once, however slow the upstream.
+	cacheEntry, err := cache.GetMetadata("foo", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `110 - "Response is Stale"`, cacheEntry.Metadata["Warning"])
+	cacheEntry, err = cache.GetMetadata("foo", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `110 - "Response is Stale"`, cacheEntry.Metadata["Warning"])
+	close(revalidating)
+
+	for i := 0; i < 100; i++ {
+		if cacheEntry, _ := cache.metadata.Get(cache.namespace("foo"), nil); cacheEntry.ObjectResults.OutExpirationTime.After(time.Now()) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cacheEntry, err = cache.GetMetadata("foo", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", cacheEntry.Metadata["Warning"])
+}
+
+func TestUnreachableBounded(t *testing.T) {
+	cache, upstream := newStaleCache(t, "testunreachablebounded", "max-age=60")
+	upstream.On("Revalidate", mock.Anything, mock.Anything).Return((*hydrator.CacheEntry)(nil), errors.New("connection refused"))
+	for i := 0; i < maxUnreachable+10; i++ {
+		cache.revalidate(strconv.Itoa(i), freshEntry())
+	}
+	assert.Equal(t, maxUnreachable, cache.unreachable.Len())
+	assert.False(t, cache.isUnreachable("0"))
+	assert.True(t, cache.isUnreachable(strconv.Itoa(maxUnreachable+9)))
+}
+
+func TestLookupAcrossExpiries(t *testing.T) {
+	upstream := new(testHydrator)
+	cache := NewCache(Config{
+		BlockSize:      int64(1 * 1024 * 1024),
+		MaxMemoryUsage: 64 * 1024 * 1024,
+		Hydrator:       upstream,
+		GroupName:      "testlookupacrossexpiries",
+	}).(*memoryCache)
+	clock := time.Now()
+	cache.now = func() time.Time { return clock }
+	entry := func(etag string) *hydrator.CacheEntry {
+		return &hydrator.CacheEntry{
+			ObjectResults: &cacheobject.ObjectResults{OutExpirationTime: clock.Add(2 * time.Minute)},
+			Metadata:      map[string]string{"Content-Length": "10", "Etag": etag},
+		}
+	}
+	getEtag := func() string {
+		cacheEntry, err := cache.GetMetadata("foo", nil, nil)
+		if !assert.Nil(t, err) {
+			return ""
+		}
+		assert.Equal(t, "", cacheEntry.Metadata["Warning"])
+		return cacheEntry.Metadata["Etag"]
+	}
+
+	first := entry(`"v1"`)
+	upstream.On("GetMetadata", "foo").Return(first, nil).Once()
+	assert.Equal(t, `"v1"`, getEtag())
+	// Nodes missing in the same minute share the lookup.
+	cache.metadata.RemoveWithoutSync(cache.namespace("foo"))
+	assert.Equal(t, `"v1"`, getEtag())
+
+	// First expiry: revalidated once for every node holding the entry.
+	clock = clock.Add(3 * time.Minute)
+	upstream.On("Revalidate", "foo", mock.Anything).Return(entry(`"v1"`), nil).Once()
+	assert.Equal(t, `"v1"`, getEtag())
+	cache.metadata.AddWithoutSync(cache.namespace("foo"), *first)
+	assert.Equal(t, `"v1"`, getEtag())
+
+	// Second expiry: the lookup of the first is not served again.
+	clock = clock.Add(3 * time.Minute)
+	upstream.On("Revalidate", "foo", mock.Anything).Return(entry(`"v2"`), nil).Once()
+	assert.Equal(t, `"v2"`, getEtag())
+
+	// A lookup whose object changed upstream is repeated in the same minute.
+	v2, _ := cache.metadata.Get(cache.namespace("foo"), nil)
+	key, err := cache.objectKey("foo", v2)
+	assert.Nil(t, err)
+	cache.verifier.markChanged(key)
+	cache.metadata.AddWithoutSync(cache.namespace("foo"), *first)
+	upstream.On("GetMetadata", "foo").Return(entry(`"v3"`), nil).Once()
+	assert.Equal(t, `"v3"`, getEtag())
+	upstream.AssertExpectations(t)
+}
+
+func TestObjectChangedOnPeers(t *testing.T) {
+	upstream := new(testHydrator)
+	cache := NewCache(Config{
+		BlockSize:      4,
+		MaxMemoryUsage: 64 * 1024 * 1024,
+		Hydrator:       upstream,
+		DiskCache:      &mapDiskCache{blocks: make(map[string][]byte)},
+		GroupName:      "testobjectchangedonpeers",
+	}).(*memoryCache)
+	remote, remoteDisk := newRemoteCache(t, "testobjectchangedonpeers")
+	received := addPeer(t, remote)
+
+	// The other node served this version and holds some of its blocks.
+	cacheEntry := freshEntry()
+	key, err := cache.objectKey("foo", cacheEntry)
+	assert.Nil(t, err)
+	remote.metadata.AddWithoutSync(remote.namespace("foo"), *cacheEntry)
+	remoteDisk.blocks[key+"-2"] = []byte("89")
+
+	upstream.On("Get", "foo", mock.Anything, mock.Anything, mock.Anything).Return(nil, hydrator.ObjectChanged{Url: "foo"})
+	reader, err := cache.Get("foo", cacheEntry, nil)
+	assert.Nil(t, err)
+	for _, offset := range []int64{0, 4} {
+		_, err = reader.ReadAt(make([]byte, 4), offset)
+		assert.NotNil(t, err)
+	}
+
+	assert.Equal(t, 1, received(), "the change is sent once")
+	assert.True(t, remote.verifier.isChanged(key))
+	_, ok := remote.metadata.Get(remote.namespace("foo"), nil)
+	assert.False(t, ok)
+	assert.Equal(t, 0, remoteDisk.len())
+}
+
+// groupcachePeer serves groupcache requests as another node holding the
+// blocks of remote until the test ends. It reads the group name from the
+// request path as groupcache.HTTPPool does.
+func groupcachePeer(t *testing.T, remote cacheContext) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/_groupcache/"), "/", 2)
+		if len(parts) != 2 || parts[0] != remote.groupName {
+			http.Error(w, "no such group: "+parts[0], http.StatusNotFound)
+			return
+		}
+		var value []byte
+		if err := getterFunc(remote, parts[1], groupcache.AllocatingByteSliceSink(&value)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body, err := proto.Marshal(&groupcachepb.GetResponse{Value: value})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestRouteBlockFromPeer(t *testing.T) {
+	route, err := router.ParseRoute("mirror.example.com/debian=http://deb.debian.org/debian")
+	assert.Nil(t, err)
+	// Only the other node holds the block, this one cannot fetch it.
+	upstream := new(testHydrator)
+	upstream.On("Get", "pool/foo.deb", mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("not the owner"))
+	cache := NewCache(Config{
+		BlockSize:      4,
+		MaxMemoryUsage: 64 * 1024 * 1024,
+		Hydrator:       upstream,
+		DiskCache:      &mapDiskCache{blocks: make(map[string][]byte)},
+		GroupName:      route.Name,
+	}).(*memoryCache)
+	cacheEntry := freshEntry()
+	key, err := cache.objectKey("pool/foo.deb", cacheEntry)
+	assert.Nil(t, err)
+	remoteDisk := &mapDiskCache{blocks: map[string][]byte{key + "-0": []byte("0123")}}
+	peer := groupcachePeer(t, cacheContext{
+		diskCache: remoteDisk,
+		hydrator:  new(testHydrator),
+		groupName: route.Name,
+	})
+
+	// The other node owns every block.
+	pool := peerPicker.(*groupcache.HTTPPool)
+	pool.Set(peer)
+	defer pool.Set(clusterPeers.self)
+
+	reader, err := cache.Get("pool/foo.deb", cacheEntry, nil)
+	assert.Nil(t, err)
+	data := make([]byte, 4)
+	n, err := reader.ReadAt(data, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "0123", string(data[:n]))
+}
@@ -2,6 +2,7 @@ package gcache
 
 import (
 	"bytes"
+	"container/list"
 	"encoding/gob"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/mvcc/mvccpb"
@@ -9,6 +10,7 @@ import (
 	"golang.org/x/net/context"
 	"log"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 )
@@ -20,14 +22,32 @@ type MetadataSyncer interface {
 }
 
 type metadataSync struct {
-	cache  MetadataCache
-	client *clientv3.Client
+	cache MetadataCache
+	kv    clientv3.KV
+	lease clientv3.Lease
+	// newWatcher opens a watcher for each watch, so an ended watch is not
+	// resumed on a broken stream.
+	newWatcher func() clientv3.Watcher
+	prefix     string
+	namespace  string
+	retention  time.Duration
 }
 
-func NewMetadataSyncer(cache MetadataCache, c *clientv3.Client) error {
+// NewMetadataSyncer shares metadata through etcd. Keys are stored escaped
+// under prefix, e.g. /casserole/default/metadata/, and only keys starting
+// with namespace are loaded. Entries are kept for retention past their
+// expiration so they can be revalidated.
+func NewMetadataSyncer(cache MetadataCache, c *clientv3.Client, prefix string, namespace string, retention time.Duration) error {
 	syncer := &metadataSync{
-		cache:  cache,
-		client: c,
+		cache: cache,
+		kv:    clientv3.NewKV(c),
+		lease: c.Lease,
+		newWatcher: func() clientv3.Watcher {
+			return clientv3.NewWatcher(c)
+		},
+		prefix:    prefix,
+		namespace: namespace,
+		retention: retention,
 	}
 
 	cache.AddSync(syncer)
@@ -36,58 +56,170 @@ func NewMetadataSyncer(cache MetadataCache, c *clientv3.Client) error {
 }
 
 func (syncer *metadataSync) Add(key string, value hydrator.CacheEntry) error {
-	kv := clientv3.NewKV(syncer.client)
 	var buf bytes.Buffer
 	encoder := gob.NewEncoder(&buf)
 	encoder.Encode(value)
 	//log.Println(value)
 	//log.Println(buf.String())
-	duration := value.ObjectResults.OutExpirationTime.Sub(time.Now())
+	duration := value.ObjectResults.OutExpirationTime.Sub(time.Now()) + syncer.retention
 	ttlInSeconds := int64(duration / time.Second)
 	//log.Println(key+" TTL:", ttlInSeconds)
-	leaseResp, err := syncer.client.Lease.Grant(context.Background(), ttlInSeconds)
+	leaseResp, err := syncer.lease.Grant(context.Background(), ttlInSeconds)
 	if err != nil {
+		metadataSyncErrors.WithLabelValues("add").Inc()
 		return err
 	}
-	_, err = kv.Put(context.TODO(), key, string(buf.Bytes()), clientv3.WithLease(leaseResp.ID))
+	_, err = syncer.kv.Put(context.TODO(), syncer.etcdKey(key), string(buf.Bytes()), clientv3.WithLease(leaseResp.ID))
 	if err != nil {
+		metadataSyncErrors.WithLabelValues("add").Inc()
 		return err
 	}
 	return err
 }
 
 func (syncer *metadataSync) Remove(key string) error {
-	kv := clientv3.NewKV(syncer.client)
-	_, err := kv.Delete(context.Background(), key)
+	_, err := syncer.kv.Delete(context.Background(), syncer.etcdKey(key))
 	if err != nil {
+		metadataSyncErrors.WithLabelValues("remove").Inc()
 		return err
 	}
 	return nil
 }
 
+// Sync loads the metadata already in etcd, then follows changes from the
+// revision of that snapshot. Watches that end are resumed from the last
+// revision seen. When that revision has been compacted the snapshot is
+// loaded again.
 func (syncer *metadataSync) Sync() {
-	// set up etcd
-	watcher := clientv3.NewWatcher(syncer.client)
-	ch := watcher.Watch(context.Background(), "", clientv3.WithPrefix())
+	var revision int64
+	for {
+		if revision == 0 {
+			var err error
+			revision, err = syncer.load()
+			if err != nil {
+				log.Println("Sync load error", err)
+				metadataSyncErrors.WithLabelValues("load").Inc()
+				time.Sleep(5 * time.Second)
+				continue
+			}
+		}
+		revision = syncer.watch(revision)
+	}
+}
+
+// load replaces the local metadata with a snapshot of etcd and returns the
+// revision of the snapshot.
+func (syncer *metadataSync) load() (int64, error) {
+	response, err := syncer.kv.Get(context.Background(), syncer.etcdKey(syncer.namespace), clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	syncer.snapshot(response.Kvs)
+	log.Println("Sync loaded", len(response.Kvs), "entries at revision", response.Header.Revision)
+	return response.Header.Revision, nil
+}
+
+func (syncer *metadataSync) snapshot(kvs []*mvccpb.KeyValue) {
+	found := make(map[string]bool, len(kvs))
+	for _, kv := range kvs {
+		if key, ok := syncer.put(kv); ok {
+			found[key] = true
+		}
+	}
+	// Deletes missed while the watch was down.
+	for _, key := range syncer.cache.Keys() {
+		if !found[key] {
+			syncer.cache.RemoveWithoutSync(key)
+		}
+	}
+}
+
+// watch applies changes after revision until the watch ends and returns the
+// last revision seen, or 0 if it was compacted.
+func (syncer *metadataSync) watch(revision int64) int64 {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(context.Background()))
+	defer cancel()
+	watcher := syncer.newWatcher()
+	defer watcher.Close()
+	ch := watcher.Watch(ctx, syncer.etcdKey(syncer.namespace), clientv3.WithPrefix(), clientv3.WithRev(revision+1))
 	for response := range ch {
+		if response.CompactRevision != 0 {
+			log.Println("Sync watch compacted at revision", response.CompactRevision, "reloading")
+			metadataSyncErrors.WithLabelValues("compacted").Inc()
+			return 0
+		}
+		if err := response.Err(); err != nil {
+			log.Println("Sync watch error", err)
+			metadataSyncErrors.WithLabelValues("watch").Inc()
+			time.Sleep(time.Second)
+			return revision
+		}
 		for _, event := range response.Events {
 			switch event.Type {
 			case mvccpb.PUT:
-				decoder := gob.NewDecoder(bytes.NewBuffer(event.Kv.Value))
-				value := hydrator.CacheEntry{}
-				decoder.Decode(&value)
-				//log.Println("Sync PUT", string(event.Kv.Key), value)
-				syncer.cache.AddWithoutSync(string(event.Kv.Key), value)
+				//log.Println("Sync PUT", string(event.Kv.Key))
+				syncer.put(event.Kv)
 			case mvccpb.DELETE:
-				log.Println("Sync DELETE", string(event.Kv.Key))
-				syncer.cache.RemoveWithoutSync(string(event.Kv.Key))
+				if key, ok := syncer.localKey(event.Kv.Key); ok {
+					log.Println("Sync DELETE", key)
+					syncer.cache.RemoveWithoutSync(key)
+				}
 			default:
 				log.Println("Sync Unknown Type")
 			}
+			revision = event.Kv.ModRevision
 		}
 	}
+	return revision
+}
+
+// put adds an etcd entry to the local cache and returns its local key.
+func (syncer *metadataSync) put(kv *mvccpb.KeyValue) (string, bool) {
+	key, ok := syncer.localKey(kv.Key)
+	if !ok {
+		return "", false
+	}
+	decoder := gob.NewDecoder(bytes.NewBuffer(kv.Value))
+	value := hydrator.CacheEntry{}
+	if err := decoder.Decode(&value); err != nil {
+		metadataSyncErrors.WithLabelValues("decode").Inc()
+		return "", false
+	}
+	syncer.cache.AddWithoutSync(key, value)
+	return key, true
+}
+
+// etcdKey escapes a local key so urls never create extra path levels.
+// Escaping is per character, so escaped prefixes stay prefixes.
+func (syncer *metadataSync) etcdKey(key string) string {
+	return syncer.prefix + url.QueryEscape(key)
+}
+
+func (syncer *metadataSync) localKey(etcdKey []byte) (string, bool) {
+	if !bytes.HasPrefix(etcdKey, []byte(syncer.prefix)) {
+		return "", false
+	}
+	key, err := url.QueryUnescape(string(etcdKey[len(syncer.prefix):]))
+	if err != nil {
+		metadataSyncErrors.WithLabelValues("decode").Inc()
+		return "", false
+	}
+	return key, true
+}
+
+// localSync keeps metadata on this node only, for clusters without etcd.
+type localSync struct{}
+
+func (_ localSync) Add(key string, value hydrator.CacheEntry) error {
+	return nil
 }
 
+func (_ localSync) Remove(key string) error {
+	return nil
+}
+
+func (_ localSync) Sync() {}
+
 type MetadataCache interface {
 	Add(key string, cacheEntry hydrator.CacheEntry) error
 	AddWithoutSync(key string, metadata hydrator.CacheEntry)
@@ -95,19 +227,45 @@ type MetadataCache interface {
 	Remove(key string)
 	RemoveWithoutSync(key string)
 	AddSync(syncer MetadataSyncer)
+	Keys() []string
+	Len() int
+	// Close stops removing expired entries in the background.
+	Close()
 }
 
+// metadataSweepInterval is how often expired metadata is removed.
+const metadataSweepInterval = time.Minute
+
 type metadataCache struct {
-	metadata map[string]hydrator.CacheEntry
-	lock     sync.RWMutex
-	syncer   MetadataSyncer
+	metadata   map[string]*list.Element
+	lru        *list.List
+	lock       sync.Mutex
+	syncer     MetadataSyncer
+	retention  time.Duration
+	maxEntries int
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+type metadataEntry struct {
+	key        string
+	cacheEntry hydrator.CacheEntry
 }
 
-func NewMetadataCache() MetadataCache {
-	return &metadataCache{
+// NewMetadataCache keeps metadata until retention past its expiration.
+// When maxEntries is positive, the least recently used entries are evicted
+// beyond it.
+func NewMetadataCache(retention time.Duration, maxEntries int) MetadataCache {
+	cache := &metadataCache{
 		// Object metadata cache [key: [header: value]]
-		metadata: make(map[string]hydrator.CacheEntry),
+		metadata:   make(map[string]*list.Element),
+		lru:        list.New(),
+		retention:  retention,
+		maxEntries: maxEntries,
+		done:       make(chan struct{}),
 	}
+	go cache.sweep(metadataSweepInterval)
+	return cache
 }
 
 func (cache *metadataCache) Add(key string, metadata hydrator.CacheEntry) error {
@@ -124,29 +282,111 @@ func (cache *metadataCache) AddWithoutSync(key string, cacheEntry hydrator.Cache
 }
 
 func (cache *metadataCache) Get(key string, clientHeaders http.Header) (*hydrator.CacheEntry, bool) {
-	cache.lock.RLock()
-	res, ok := cache.metadata[key]
-	cache.lock.RUnlock()
-	return &res, ok
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, ok := cache.metadata[key]
+	if !ok {
+		return &hydrator.CacheEntry{}, false
+	}
+	entry := element.Value.(*metadataEntry)
+	if cache.expired(entry, time.Now()) {
+		cache.removeElement(element)
+		metadataEvictions.WithLabelValues("expired").Inc()
+		return &hydrator.CacheEntry{}, false
+	}
+	cache.lru.MoveToFront(element)
+	res := entry.cacheEntry
+	return &res, true
 }
 
 func (cache *metadataCache) Remove(key string) {
-	cache.lock.Lock()
-	delete(cache.metadata, key)
-	cache.lock.Unlock()
+	if err := cache.syncer.Remove(key); err != nil {
+		log.Println("Unable to remove metadata", key, err)
+	}
+	cache.RemoveWithoutSync(key)
 }
 
 func (cache *metadataCache) RemoveWithoutSync(key string) {
 	cache.lock.Lock()
-	cache.syncer.Remove(key)
-	delete(cache.metadata, key)
+	if element, ok := cache.metadata[key]; ok {
+		cache.removeElement(element)
+	}
 	cache.lock.Unlock()
 }
 
+func (cache *metadataCache) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return len(cache.metadata)
+}
+
+func (cache *metadataCache) Keys() []string {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	keys := make([]string, 0, len(cache.metadata))
+	for k := range cache.metadata {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
 func (cache *metadataCache) add(key string, cacheEntry hydrator.CacheEntry) {
 	cache.lock.Lock()
-	cache.metadata[key] = cacheEntry
-	cache.lock.Unlock()
+	defer cache.lock.Unlock()
+	if element, ok := cache.metadata[key]; ok {
+		element.Value.(*metadataEntry).cacheEntry = cacheEntry
+		cache.lru.MoveToFront(element)
+		return
+	}
+	cache.metadata[key] = cache.lru.PushFront(&metadataEntry{key: key, cacheEntry: cacheEntry})
+	for cache.maxEntries > 0 && cache.lru.Len() > cache.maxEntries {
+		cache.removeElement(cache.lru.Back())
+		metadataEvictions.WithLabelValues("capacity").Inc()
+	}
+}
+
+// expired reports whether an entry is past its retention and can no
+// longer be revalidated. Entries that are merely stale are kept.
+func (cache *metadataCache) expired(entry *metadataEntry, now time.Time) bool {
+	results := entry.cacheEntry.ObjectResults
+	return results == nil || now.After(results.OutExpirationTime.Add(cache.retention))
+}
+
+func (cache *metadataCache) removeElement(element *list.Element) {
+	cache.lru.Remove(element)
+	delete(cache.metadata, element.Value.(*metadataEntry).key)
+}
+
+// sweep removes expired entries every interval, so entries whose etcd
+// delete was missed do not stay around until they are read.
+func (cache *metadataCache) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cache.removeExpired(time.Now())
+		case <-cache.done:
+			return
+		}
+	}
+}
+
+func (cache *metadataCache) Close() {
+	cache.closeOnce.Do(func() {
+		close(cache.done)
+	})
+}
+
+func (cache *metadataCache) removeExpired(now time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for _, element := range cache.metadata {
+		if cache.expired(element.Value.(*metadataEntry), now) {
+			cache.removeElement(element)
+			metadataEvictions.WithLabelValues("expired").Inc()
+		}
+	}
 }
 
 func (cache *metadataCache) AddSync(syncer MetadataSyncer) {
@@ -0,0 +1,197 @@
+package gcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func expiringAt(expiration time.Time) hydrator.CacheEntry {
+	return hydrator.CacheEntry{
+		ObjectResults: &cacheobject.ObjectResults{OutExpirationTime: expiration},
+	}
+}
+
+func TestMetadataCacheExpiry(t *testing.T) {
+	cache := NewMetadataCache(time.Hour, 0)
+	defer cache.Close()
+	cache.AddSync(localSync{})
+	now := time.Now()
+	cache.Add("fresh", expiringAt(now.Add(time.Minute)))
+	cache.Add("stale", expiringAt(now.Add(-time.Minute)))
+	cache.Add("expired", expiringAt(now.Add(-2*time.Hour)))
+
+	_, ok := cache.Get("fresh", nil)
+	assert.True(t, ok)
+	_, ok = cache.Get("stale", nil)
+	assert.True(t, ok, "stale entries are kept for revalidation")
+	_, ok = cache.Get("expired", nil)
+	assert.False(t, ok)
+	assert.Equal(t, 2, cache.Len())
+
+	cache.(*metadataCache).removeExpired(now.Add(2 * time.Hour))
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestMetadataCacheEviction(t *testing.T) {
+	cache := NewMetadataCache(time.Hour, 2)
+	defer cache.Close()
+	cache.AddSync(localSync{})
+	expiration := time.Now().Add(time.Minute)
+	cache.Add("a", expiringAt(expiration))
+	cache.Add("b", expiringAt(expiration))
+	cache.Get("a", nil)
+	cache.Add("c", expiringAt(expiration))
+
+	assert.ElementsMatch(t, []string{"a", "c"}, cache.Keys())
+}
+
+func TestMetadataCacheClose(t *testing.T) {
+	cache := NewMetadataCache(time.Hour, 0).(*metadataCache)
+	cache.Close()
+	cache.Close()
+
+	done := make(chan struct{})
+	go func() {
+		cache.sweep(time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sweep did not stop")
+	}
+}
+
+func TestMetadataSyncSnapshot(t *testing.T) {
+	cache := NewMetadataCache(time.Hour, 0)
+	defer cache.Close()
+	cache.AddSync(localSync{})
+	expiration := time.Now().Add(time.Minute)
+	cache.AddWithoutSync("maven/deleted", expiringAt(expiration))
+	cache.AddWithoutSync("maven/kept", expiringAt(expiration))
+
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(expiringAt(expiration))
+	syncer := &metadataSync{cache: cache, prefix: "/casserole/test/metadata/", namespace: "maven/"}
+	syncer.snapshot([]*mvccpb.KeyValue{
+		{Key: []byte("/casserole/test/metadata/maven%2Fkept"), Value: buf.Bytes()},
+		{Key: []byte(syncer.etcdKey("maven/org/a.jar?v=1&x=%")), Value: buf.Bytes()},
+		{Key: []byte("/casserole/test/peers/unrelated"), Value: buf.Bytes()},
+		{Key: []byte("/casserole/test/metadata/%zz"), Value: buf.Bytes()},
+	})
+
+	assert.ElementsMatch(t, []string{"maven/kept", "maven/org/a.jar?v=1&x=%"}, cache.Keys())
+	assert.Equal(t, "/casserole/test/metadata/maven%2F", syncer.etcdKey(syncer.namespace))
+}
+
+// fakeKV serves Get from a list of snapshots, one per call.
+type fakeKV struct {
+	clientv3.KV
+	snapshots []*clientv3.GetResponse
+}
+
+func (kv *fakeKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	response := kv.snapshots[0]
+	kv.snapshots = kv.snapshots[1:]
+	return response, nil
+}
+
+// fakeWatcher answers each watch with a list of responses, then closes the
+// channel. Watches past the last list stay open.
+type fakeWatcher struct {
+	responses [][]clientv3.WatchResponse
+	revisions chan int64
+}
+
+func (w *fakeWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	w.revisions <- clientv3.OpGet(key, opts...).Rev()
+	ch := make(chan clientv3.WatchResponse, 10)
+	if len(w.responses) == 0 {
+		return ch
+	}
+	for _, response := range w.responses[0] {
+		ch <- response
+	}
+	w.responses = w.responses[1:]
+	close(ch)
+	return ch
+}
+
+func (w *fakeWatcher) RequestProgress(ctx context.Context) error { return nil }
+func (w *fakeWatcher) Close() error                              { return nil }
+
+func newFakeSync(kv *fakeKV, watcher *fakeWatcher) (*metadataSync, MetadataCache) {
+	cache := NewMetadataCache(time.Hour, 0)
+	cache.AddSync(localSync{})
+	syncer := &metadataSync{
+		cache:      cache,
+		kv:         kv,
+		newWatcher: func() clientv3.Watcher { return watcher },
+		prefix:     "/casserole/test/metadata/",
+		namespace:  "maven/",
+	}
+	return syncer, cache
+}
+
+func encodedEntry(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(expiringAt(time.Now().Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMetadataSyncResume(t *testing.T) {
+	value := encodedEntry(t)
+	watcher := &fakeWatcher{
+		revisions: make(chan int64, 10),
+		responses: [][]clientv3.WatchResponse{{
+			{Events: []*clientv3.Event{
+				{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("/casserole/test/metadata/maven%2Fb"), Value: value, ModRevision: 11}},
+				{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte("/casserole/test/metadata/maven%2Fa"), ModRevision: 12}},
+			}},
+		}},
+	}
+	syncer, cache := newFakeSync(&fakeKV{}, watcher)
+	defer cache.Close()
+	cache.AddWithoutSync("maven/a", expiringAt(time.Now().Add(time.Minute)))
+
+	assert.Equal(t, int64(12), syncer.watch(10))
+	assert.Equal(t, int64(11), <-watcher.revisions, "resumed after the last revision seen")
+	assert.Equal(t, []string{"maven/b"}, cache.Keys())
+}
+
+func TestMetadataSyncCompacted(t *testing.T) {
+	value := encodedEntry(t)
+	kv := &fakeKV{snapshots: []*clientv3.GetResponse{
+		{
+			Header: &etcdserverpb.ResponseHeader{Revision: 20},
+			Kvs:    []*mvccpb.KeyValue{{Key: []byte("/casserole/test/metadata/maven%2Fa"), Value: value}},
+		},
+		{
+			Header: &etcdserverpb.ResponseHeader{Revision: 30},
+			Kvs:    []*mvccpb.KeyValue{{Key: []byte("/casserole/test/metadata/maven%2Fb"), Value: value}},
+		},
+	}}
+	watcher := &fakeWatcher{
+		revisions: make(chan int64, 10),
+		responses: [][]clientv3.WatchResponse{{{CompactRevision: 25}}},
+	}
+	syncer, cache := newFakeSync(kv, watcher)
+	defer cache.Close()
+
+	go syncer.Sync()
+	assert.Equal(t, int64(21), <-watcher.revisions)
+	assert.Equal(t, int64(31), <-watcher.revisions, "reloaded after compaction")
+	assert.Equal(t, []string{"maven/b"}, cache.Keys(), "entries deleted while compacted are dropped")
+}
@@ -0,0 +1,143 @@
+package gcache
+
+import (
+	"sync"
+
+	"github.com/golang/groupcache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tierRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "casserole",
+		Name:      "tier_requests_total",
+		Help:      "Metadata and disk lookups by tier and result (hit or miss).",
+	}, []string{"group", "tier", "result"})
+	metadataSyncErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "casserole",
+		Subsystem: "metadata",
+		Name:      "sync_errors_total",
+		Help:      "Errors sharing metadata through etcd by operation.",
+	}, []string{"operation"})
+	blockChecksumMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "casserole",
+		Subsystem: "block",
+		Name:      "checksum_mismatches_total",
+		Help:      "Blocks from memory or a peer that did not match their checksum and were refetched.",
+	}, []string{"group", "tier"})
+	objectVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "casserole",
+		Subsystem: "object",
+		Name:      "verifications_total",
+		Help:      "Objects verified against their upstream digest by result (ok or mismatch).",
+	}, []string{"group", "result"})
+	metadataEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "casserole",
+		Subsystem: "metadata",
+		Name:      "evictions_total",
+		Help:      "Metadata entries removed locally by reason (expired or capacity).",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(tierRequests, metadataSyncErrors, metadataEvictions, blockChecksumMismatches, objectVerifications, collector)
+}
+
+func countTier(group string, tier string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	tierRequests.WithLabelValues(group, tier, result).Inc()
+}
+
+// cacheCollector exports groupcache statistics and metadata cache sizes of
+// every memoryCache.
+type cacheCollector struct {
+	lock   sync.Mutex
+	caches []*memoryCache
+}
+
+var collector = &cacheCollector{}
+
+func (c *cacheCollector) add(mc *memoryCache) {
+	c.lock.Lock()
+	c.caches = append(c.caches, mc)
+	c.lock.Unlock()
+}
+
+var (
+	groupLabels = []string{"group"}
+	cacheLabels = []string{"group", "cache"}
+
+	groupGetsDesc           = newDesc("gets_total", "Groupcache get requests, including from peers.", groupLabels)
+	groupHitsDesc           = newDesc("cache_hits_total", "Groupcache gets served from the main or hot cache.", groupLabels)
+	groupPeerLoadsDesc      = newDesc("peer_loads_total", "Groupcache loads served by a peer.", groupLabels)
+	groupPeerErrorsDesc     = newDesc("peer_errors_total", "Groupcache loads from a peer that failed.", groupLabels)
+	groupLoadsDesc          = newDesc("loads_total", "Groupcache gets that missed the caches.", groupLabels)
+	groupLoadsDedupedDesc   = newDesc("loads_deduped_total", "Groupcache loads after singleflight deduplication.", groupLabels)
+	groupLocalLoadsDesc     = newDesc("local_loads_total", "Groupcache loads from disk or upstream on this node.", groupLabels)
+	groupLocalLoadErrsDesc  = newDesc("local_load_errors_total", "Groupcache loads on this node that failed.", groupLabels)
+	groupServerRequestsDesc = newDesc("server_requests_total", "Groupcache gets received from peers.", groupLabels)
+
+	cacheBytesDesc     = newDesc("cache_bytes", "Bytes in the groupcache main or hot cache.", cacheLabels)
+	cacheItemsDesc     = newDesc("cache_items", "Items in the groupcache main or hot cache.", cacheLabels)
+	cacheGetsDesc      = newDesc("cache_gets_total", "Gets of the groupcache main or hot cache.", cacheLabels)
+	cacheHitsDesc      = newDesc("cache_cache_hits_total", "Hits of the groupcache main or hot cache.", cacheLabels)
+	cacheEvictionsDesc = newDesc("cache_evictions_total", "Evictions from the groupcache main or hot cache.", cacheLabels)
+
+	metadataEntriesDesc = prometheus.NewDesc("casserole_metadata_entries", "Entries in the metadata cache.", groupLabels, nil)
+)
+
+func newDesc(name string, help string, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc("casserole_groupcache_"+name, help, labels, nil)
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		groupGetsDesc, groupHitsDesc, groupPeerLoadsDesc, groupPeerErrorsDesc, groupLoadsDesc,
+		groupLoadsDedupedDesc, groupLocalLoadsDesc, groupLocalLoadErrsDesc, groupServerRequestsDesc,
+		cacheBytesDesc, cacheItemsDesc, cacheGetsDesc, cacheHitsDesc, cacheEvictionsDesc,
+		metadataEntriesDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	caches := c.caches
+	c.lock.Unlock()
+
+	for _, mc := range caches {
+		name := mc.groupName
+		stats := &mc.group.Stats
+		for desc, value := range map[*prometheus.Desc]int64{
+			groupGetsDesc:           stats.Gets.Get(),
+			groupHitsDesc:           stats.CacheHits.Get(),
+			groupPeerLoadsDesc:      stats.PeerLoads.Get(),
+			groupPeerErrorsDesc:     stats.PeerErrors.Get(),
+			groupLoadsDesc:          stats.Loads.Get(),
+			groupLoadsDedupedDesc:   stats.LoadsDeduped.Get(),
+			groupLocalLoadsDesc:     stats.LocalLoads.Get(),
+			groupLocalLoadErrsDesc:  stats.LocalLoadErrs.Get(),
+			groupServerRequestsDesc: stats.ServerRequests.Get(),
+		} {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), name)
+		}
+
+		for cacheName, cacheType := range map[string]groupcache.CacheType{
+			"main": groupcache.MainCache,
+			"hot":  groupcache.HotCache,
+		} {
+			cacheStats := mc.group.CacheStats(cacheType)
+			ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(cacheStats.Bytes), name, cacheName)
+			ch <- prometheus.MustNewConstMetric(cacheItemsDesc, prometheus.GaugeValue, float64(cacheStats.Items), name, cacheName)
+			ch <- prometheus.MustNewConstMetric(cacheGetsDesc, prometheus.CounterValue, float64(cacheStats.Gets), name, cacheName)
+			ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(cacheStats.Hits), name, cacheName)
+			ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(cacheStats.Evictions), name, cacheName)
+		}
+
+		ch <- prometheus.MustNewConstMetric(metadataEntriesDesc, prometheus.GaugeValue, float64(mc.metadata.Len()), name)
+	}
+}
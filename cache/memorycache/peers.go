@@ -0,0 +1,388 @@
+package gcache
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/golang/groupcache/consistenthash"
+)
+
+// Nodes tell each other about purged, changed and untrusted objects through
+// invalidatePath on the peering address. Groupcache cannot remove entries,
+// so a purge also raises the generation of its group, which is part of every
+// metadata and block key: entries of the previous generation are never read
+// again and age out of the memory caches.
+
+// invalidatePath is served on the peering address. POST applies an
+// invalidation, GET returns the peerState of this node.
+const invalidatePath = "/_casserole/invalidate"
+
+// peerSecretHeader carries the peer secret on requests between nodes.
+const peerSecretHeader = "X-Casserole-Peer-Secret"
+
+// peerSecret, when set, must be sent by peers. Without it, only requests
+// from the addresses of known peers are accepted.
+var peerSecret string
+
+var peerClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+type peerList struct {
+	lock  sync.RWMutex
+	self  string
+	peers []string
+	// seen holds every peer ever set, to tell which peers are new.
+	seen map[string]bool
+	// ring picks the owner of a key as the groupcache pool does.
+	ring *consistenthash.Map
+}
+
+// poolReplicas is the number of replicas of each peer in the hash ring of
+// groupcache.HTTPPool.
+const poolReplicas = 50
+
+// clusterPeers tracks the peering addresses of the cluster so invalidations
+// can be sent to every node.
+var clusterPeers = &peerList{}
+
+// Set replaces the peers and returns those not seen before, except this
+// node.
+func (list *peerList) Set(peers ...string) []string {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	list.peers = peers
+	list.ring = consistenthash.New(poolReplicas, nil)
+	list.ring.Add(peers...)
+	if list.seen == nil {
+		list.seen = make(map[string]bool)
+	}
+	var added []string
+	for _, peer := range peers {
+		if !list.seen[peer] && peer != list.self {
+			added = append(added, peer)
+		}
+		list.seen[peer] = true
+	}
+	return added
+}
+
+// Others returns every known peer except this node.
+func (list *peerList) Others() []string {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	var others []string
+	for _, peer := range list.peers {
+		if peer != list.self {
+			others = append(others, peer)
+		}
+	}
+	return others
+}
+
+// owner returns the peer owning a block, or "" without peers.
+func (list *peerList) owner(request dataRequest) (string, error) {
+	key, err := request.groupKey()
+	if err != nil {
+		return "", err
+	}
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	if list.ring == nil || list.ring.IsEmpty() {
+		return "", nil
+	}
+	return list.ring.Get(key), nil
+}
+
+// authorized reports whether a request comes from a peer: it carries the
+// peer secret or, without one, comes from the address of a known peer.
+func (list *peerList) authorized(r *http.Request) bool {
+	if peerSecret != "" {
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get(peerSecretHeader)), []byte(peerSecret)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return false
+	}
+	list.lock.RLock()
+	peers := append([]string{list.self}, list.peers...)
+	list.lock.RUnlock()
+	for _, peer := range peers {
+		u, err := url.Parse(peer)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		addrs, err := net.LookupHost(u.Hostname())
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if remote.Equal(net.ParseIP(addr)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var (
+	groupsLock sync.Mutex
+	// groups holds the caches of this node by group name.
+	groups = make(map[string]*memoryCache)
+	// generations holds the generation of every group, including groups
+	// of peers this node does not serve.
+	generations = make(map[string]int64)
+)
+
+func registerGroup(mc *memoryCache) {
+	groupsLock.Lock()
+	groups[mc.groupName] = mc
+	groupsLock.Unlock()
+}
+
+func lookupGroup(group string) *memoryCache {
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	return groups[group]
+}
+
+// generation returns the generation of a group, zero until it is purged.
+func generation(group string) int64 {
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	return generations[group]
+}
+
+// raiseGeneration sets the generation of a group unless it is already
+// higher, so generations agree across the cluster in whatever order they
+// arrive.
+func raiseGeneration(group string, value int64) {
+	groupsLock.Lock()
+	if value > generations[group] {
+		generations[group] = value
+	}
+	groupsLock.Unlock()
+}
+
+// nextGeneration raises the generation of a group to a new value, the
+// current time so that nodes purging at once do not pick the same one.
+func nextGeneration(group string) int64 {
+	groupsLock.Lock()
+	defer groupsLock.Unlock()
+	next := time.Now().UnixNano()
+	if next <= generations[group] {
+		next = generations[group] + 1
+	}
+	generations[group] = next
+	return next
+}
+
+// invalidation is sent to every node when objects must no longer be served.
+type invalidation struct {
+	Group string
+	// Generation raises the generation of the group.
+	Generation int64 `json:",omitempty"`
+	// Purge removes the metadata of matching urls, and their disk blocks
+	// if Blocks is set.
+	Purge  *hydrator.PurgeMatch `json:",omitempty"`
+	Blocks bool                 `json:",omitempty"`
+	// Version is an object version that changed upstream or failed
+	// verification.
+	Version *objectVersion `json:",omitempty"`
+}
+
+// objectVersion names a version of an object and why it is dropped.
+type objectVersion struct {
+	Url  string
+	Key  string
+	Size int64
+	// Untrusted is set when the version failed verification, otherwise it
+	// changed upstream.
+	Untrusted bool `json:",omitempty"`
+}
+
+// invalidate applies an invalidation on this node and returns the urls it
+// purged. local is set on the node the invalidation started from, which
+// also removes the metadata from etcd.
+func (mc *memoryCache) invalidate(message invalidation, local bool) ([]string, error) {
+	remove := mc.metadata.RemoveWithoutSync
+	if local {
+		remove = mc.metadata.Remove
+	}
+	if version := message.Version; version != nil {
+		if version.Untrusted {
+			untrustedVersions.add(version.Key)
+		} else {
+			mc.verifier.markChanged(version.Key)
+		}
+		if cacheEntry, ok := mc.metadata.Get(mc.namespace(version.Url), nil); ok {
+			if current, err := mc.objectKey(version.Url, cacheEntry); err == nil && current == version.Key {
+				remove(mc.namespace(version.Url))
+			}
+		}
+		removeBlocks(mc.diskCache, objectBlockKeys(version.Key, version.Size, mc.blockSize))
+	}
+	if message.Purge == nil {
+		return nil, nil
+	}
+	match, err := message.Purge.Matcher()
+	if err != nil {
+		return nil, err
+	}
+	return mc.purgeLocally(match, message.Blocks, remove), nil
+}
+
+// broadcast sends an invalidation to every other node and returns the urls
+// they purged.
+func broadcast(message invalidation) ([]string, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	var purged []string
+	var failed []string
+	for _, peer := range clusterPeers.Others() {
+		urls, err := sendInvalidation(peer, body)
+		if err != nil {
+			log.Println("Unable to invalidate on", peer, err)
+			failed = append(failed, peer)
+			continue
+		}
+		purged = append(purged, urls...)
+	}
+	if len(failed) > 0 {
+		return purged, errors.New("Unable to invalidate on " + strings.Join(failed, ", "))
+	}
+	return purged, nil
+}
+
+func sendInvalidation(peer string, body []byte) ([]string, error) {
+	request, err := http.NewRequest("POST", peer+invalidatePath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := peerRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var purged []string
+	if err := json.NewDecoder(resp.Body).Decode(&purged); err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+// peerRequest sends a request to a peer with the peer secret.
+func peerRequest(request *http.Request) (*http.Response, error) {
+	if peerSecret != "" {
+		request.Header.Set(peerSecretHeader, peerSecret)
+	}
+	resp, err := peerClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	return resp, nil
+}
+
+// peerState is what a node joining the cluster learns from its peers.
+type peerState struct {
+	// Generations holds the generation of every group.
+	Generations map[string]int64
+	// Untrusted holds the keys of the versions that failed verification.
+	Untrusted []string
+}
+
+// pullState raises the generations of this node to those of a peer and
+// adds the versions it does not trust, so a node that missed invalidations
+// while it was away does not read entries of earlier generations or serve
+// untrusted versions.
+func pullState(peer string) {
+	request, err := http.NewRequest("GET", peer+invalidatePath, nil)
+	if err != nil {
+		return
+	}
+	resp, err := peerRequest(request)
+	if err != nil {
+		log.Println("Unable to get state from", peer, err)
+		return
+	}
+	defer resp.Body.Close()
+	var state peerState
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		log.Println("Unable to get state from", peer, err)
+		return
+	}
+	for group, value := range state.Generations {
+		raiseGeneration(group, value)
+	}
+	for _, key := range state.Untrusted {
+		untrustedVersions.add(key)
+	}
+}
+
+// invalidateHandler serves invalidatePath to the peers of this node.
+func invalidateHandler(peers *peerList, lookup func(group string) *memoryCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !peers.authorized(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case "GET":
+			state := peerState{
+				Generations: make(map[string]int64),
+				Untrusted:   untrustedVersions.list(),
+			}
+			groupsLock.Lock()
+			for group, value := range generations {
+				state.Generations[group] = value
+			}
+			groupsLock.Unlock()
+			json.NewEncoder(w).Encode(state)
+		case "POST":
+			var message invalidation
+			if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if version := message.Version; version != nil && (!objectKeyRegex.MatchString(version.Key) || version.Size < 0) {
+				http.Error(w, "invalid object version", http.StatusBadRequest)
+				return
+			}
+			raiseGeneration(message.Group, message.Generation)
+			purged := []string{}
+			if mc := lookup(message.Group); mc != nil {
+				urls, err := mc.invalidate(message, false)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				purged = append(purged, urls...)
+			}
+			json.NewEncoder(w).Encode(purged)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
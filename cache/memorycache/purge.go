@@ -0,0 +1,108 @@
+package gcache
+
+import (
+	"encoding/hex"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fkautz/casserole/cache/diskcache"
+	"github.com/fkautz/casserole/cache/hydrator"
+)
+
+var objectKeyRegex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Purge raises the generation of the group on every node, so no metadata
+// lookup or block cached in memory before the purge is read again, then
+// has every node remove the metadata of the urls it knows that match.
+func (mc *memoryCache) Purge(purgeMatch hydrator.PurgeMatch, blocks bool) ([]string, error) {
+	match, err := purgeMatch.Matcher()
+	if err != nil {
+		return nil, err
+	}
+	message := invalidation{
+		Group:      mc.groupName,
+		Generation: nextGeneration(mc.groupName),
+		Purge:      &purgeMatch,
+		Blocks:     blocks,
+	}
+	purged := mc.purgeLocally(match, blocks, mc.metadata.Remove)
+	peerPurged, err := broadcast(message)
+	return mergeUrls(purged, peerPurged), err
+}
+
+// purgeLocally removes the metadata of matching urls on this node with
+// remove, and their disk blocks if blocks is set.
+func (mc *memoryCache) purgeLocally(match func(url string) bool, blocks bool, remove func(key string)) []string {
+	prefix := mc.namespace("")
+	var purged []string
+	for _, key := range mc.metadata.Keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		url := key[len(prefix):]
+		if !match(url) {
+			continue
+		}
+		cacheEntry, ok := mc.metadata.Get(key, nil)
+		remove(key)
+		purged = append(purged, url)
+		if blocks && ok {
+			keys, err := mc.blockKeys(url, cacheEntry)
+			if err != nil {
+				log.Println("Unable to find blocks of", url, err)
+				continue
+			}
+			removeBlocks(mc.diskCache, keys)
+		}
+	}
+	return purged
+}
+
+// mergeUrls returns the sorted union of two lists of urls.
+func mergeUrls(a, b []string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, url := range append(a, b...) {
+		if !seen[url] {
+			seen[url] = true
+			merged = append(merged, url)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// blockKeys returns the disk cache keys of every block of an object.
+func (mc *memoryCache) blockKeys(url string, cacheEntry *hydrator.CacheEntry) ([]string, error) {
+	sum, err := GenerateKey(mc.namespace(url), cacheEntry.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	key := hex.EncodeToString(sum[:])
+	totalSize, err := strconv.ParseInt(cacheEntry.Metadata["Content-Length"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return objectBlockKeys(key, totalSize, mc.blockSize), nil
+}
+
+func objectBlockKeys(key string, totalSize int64, blockSize int64) []string {
+	blockCount := int(totalSize/blockSize + 1)
+	keys := make([]string, 0, blockCount)
+	for i := 0; i < blockCount; i++ {
+		keys = append(keys, key+"-"+strconv.Itoa(i))
+	}
+	return keys
+}
+
+func removeBlocks(diskCache diskcache.Cache, keys []string) {
+	if diskCache == nil {
+		return
+	}
+	for _, key := range keys {
+		diskCache.Remove(key)
+	}
+}
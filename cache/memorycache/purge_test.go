@@ -0,0 +1,199 @@
+package gcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/stretchr/testify/assert"
+)
+
+// newRemoteCache returns the cache of a group as another node holds it.
+func newRemoteCache(t *testing.T, group string) (*memoryCache, *mapDiskCache) {
+	diskCache := &mapDiskCache{blocks: make(map[string][]byte)}
+	cache := &memoryCache{
+		groupName: group,
+		metadata:  NewMetadataCache(time.Hour, 0),
+		verifier:  newObjectVerifier(),
+		diskCache: diskCache,
+		blockSize: 4,
+	}
+	t.Cleanup(cache.metadata.Close)
+	return cache, diskCache
+}
+
+// addPeer serves invalidations to remote as another node of the cluster
+// until the test ends, and returns how many it received.
+func addPeer(t *testing.T, remote *memoryCache) func() int {
+	var lock sync.Mutex
+	received := 0
+	handler := invalidateHandler(clusterPeers, func(group string) *memoryCache {
+		if group == remote.groupName {
+			return remote
+		}
+		return nil
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		received++
+		lock.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	self := clusterPeers.self
+	clusterPeers.Set(self, server.URL)
+	t.Cleanup(func() {
+		server.Close()
+		clusterPeers.Set(self)
+	})
+	return func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return received
+	}
+}
+
+func TestPurge(t *testing.T) {
+	upstream := new(testHydrator)
+	upstream.On("GetMetadata", "foo").Return(freshEntry(), nil).Twice()
+	cache := NewCache(Config{
+		BlockSize:      4,
+		MaxMemoryUsage: 64 * 1024 * 1024,
+		Hydrator:       upstream,
+		GroupName:      "testpurge",
+	}).(*memoryCache)
+
+	_, err := cache.GetMetadata("foo", nil, nil)
+	assert.Nil(t, err)
+	// Dropping the metadata alone still finds the lookup in groupcache.
+	cache.metadata.RemoveWithoutSync(cache.namespace("foo"))
+	_, err = cache.GetMetadata("foo", nil, nil)
+	assert.Nil(t, err)
+
+	before := generation("testpurge")
+	purged, err := cache.Purge(hydrator.PurgeMatch{Url: "foo"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo"}, purged)
+	assert.True(t, generation("testpurge") > before)
+	_, ok := cache.metadata.Get(cache.namespace("foo"), nil)
+	assert.False(t, ok)
+
+	// A purged lookup is fetched again.
+	_, err = cache.GetMetadata("foo", nil, nil)
+	assert.Nil(t, err)
+	upstream.AssertExpectations(t)
+}
+
+func TestPurgeOnPeers(t *testing.T) {
+	diskCache := &mapDiskCache{blocks: make(map[string][]byte)}
+	cache := NewCache(Config{
+		BlockSize:      4,
+		MaxMemoryUsage: 64 * 1024 * 1024,
+		Hydrator:       new(testHydrator),
+		DiskCache:      diskCache,
+		GroupName:      "testpurgeonpeers",
+	}).(*memoryCache)
+	remote, remoteDisk := newRemoteCache(t, "testpurgeonpeers")
+	addPeer(t, remote)
+
+	// Each node only knows the objects it served.
+	cache.metadata.AddWithoutSync(cache.namespace("org/a.jar"), *freshEntry())
+	remote.metadata.AddWithoutSync(remote.namespace("org/b.jar"), *freshEntry())
+	remote.metadata.AddWithoutSync(remote.namespace("com/c.jar"), *freshEntry())
+	localKeys, err := cache.blockKeys("org/a.jar", freshEntry())
+	assert.Nil(t, err)
+	remoteKeys, err := remote.blockKeys("org/b.jar", freshEntry())
+	assert.Nil(t, err)
+	for _, key := range localKeys {
+		diskCache.blocks[key] = []byte("data")
+	}
+	for _, key := range remoteKeys {
+		remoteDisk.blocks[key] = []byte("data")
+	}
+
+	generationBefore := generation("testpurgeonpeers")
+	purged, err := cache.Purge(hydrator.PurgeMatch{Prefix: "org/"}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"org/a.jar", "org/b.jar"}, purged)
+	assert.True(t, generation("testpurgeonpeers") > generationBefore)
+	assert.Equal(t, 0, diskCache.len())
+	assert.Equal(t, 0, remoteDisk.len())
+	assert.Equal(t, []string{remote.namespace("com/c.jar")}, remote.metadata.Keys())
+}
+
+func TestPurgeUnreachablePeer(t *testing.T) {
+	cache := NewCache(Config{
+		BlockSize:      4,
+		MaxMemoryUsage: 64 * 1024 * 1024,
+		Hydrator:       new(testHydrator),
+		GroupName:      "testpurgeunreachablepeer",
+	}).(*memoryCache)
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	self := clusterPeers.self
+	clusterPeers.Set(self, server.URL)
+	defer clusterPeers.Set(self)
+
+	cache.metadata.AddWithoutSync(cache.namespace("foo"), *freshEntry())
+	purged, err := cache.Purge(hydrator.PurgeMatch{Url: "foo"}, false)
+	assert.Equal(t, []string{"foo"}, purged)
+	assert.NotNil(t, err)
+}
+
+func TestInvalidateHandler(t *testing.T) {
+	peers := &peerList{self: "http://192.0.2.1:8000"}
+	peers.Set("http://192.0.2.1:8000", "http://192.0.2.2:8000")
+	remote, remoteDisk := newRemoteCache(t, "testinvalidatehandler")
+	handler := invalidateHandler(peers, func(group string) *memoryCache {
+		return remote
+	})
+	send := func(method, body, remoteAddr, secret string) int {
+		request := httptest.NewRequest(method, invalidatePath, strings.NewReader(body))
+		request.RemoteAddr = remoteAddr
+		if secret != "" {
+			request.Header.Set(peerSecretHeader, secret)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, send("GET", "", "198.51.100.1:1234", ""))
+	assert.Equal(t, http.StatusOK, send("GET", "", "192.0.2.2:1234", ""))
+
+	key := strings.Repeat("ab", 32)
+	remoteDisk.blocks[key+"-0"] = []byte("data")
+	version := `{"Group":"testinvalidatehandler","Version":{"Url":"foo","Key":"` + key + `","Size":4}}`
+	assert.Equal(t, http.StatusOK, send("POST", version, "192.0.2.2:1234", ""))
+	assert.Equal(t, 0, remoteDisk.len())
+	assert.True(t, remote.verifier.isChanged(key))
+	assert.Equal(t, http.StatusBadRequest, send("POST", `{"Group":"testinvalidatehandler","Version":{"Url":"foo","Key":"../etc"}}`, "192.0.2.2:1234", ""))
+
+	// With a secret, the address of a peer is not enough.
+	peerSecret = "secret"
+	defer func() { peerSecret = "" }()
+	assert.Equal(t, http.StatusForbidden, send("GET", "", "192.0.2.2:1234", ""))
+	assert.Equal(t, http.StatusForbidden, send("GET", "", "192.0.2.2:1234", "wrong"))
+	assert.Equal(t, http.StatusOK, send("GET", "", "198.51.100.1:1234", "secret"))
+}
+
+func TestPullState(t *testing.T) {
+	peerSecret = "secret"
+	defer func() { peerSecret = "" }()
+	untrusted := strings.Repeat("cd", 32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get(peerSecretHeader))
+		w.Write([]byte(`{"Generations":{"testpullstate":42},"Untrusted":["` + untrusted + `"]}`))
+	}))
+	defer server.Close()
+
+	// A node that was away learns of the invalidations it missed.
+	pullState(server.URL)
+	assert.Equal(t, int64(42), generation("testpullstate"))
+	raiseGeneration("testpullstate", 7)
+	assert.Equal(t, int64(42), generation("testpullstate"))
+	assert.True(t, untrustedVersions.contains(untrusted))
+}
@@ -0,0 +1,111 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/fkautz/casserole/cache/hydrator"
+)
+
+// A Route maps requests for a Host and/or path prefix to an upstream base url.
+// Each route owns its own cache so keys never collide between upstreams.
+type Route struct {
+	Name       string
+	Host       string
+	PathPrefix string
+	Upstream   string
+	Cache      hydrator.Cache
+}
+
+type NoRoute struct{}
+
+func (_ NoRoute) Error() string {
+	return "No Route"
+}
+
+// ParseRoute parses a route of the form "[host][/path/prefix]=upstream", e.g.
+// "repo.example.com=http://upstream", "/maven=https://repo1.maven.org/maven2"
+// or "mirror.example.com/debian=http://deb.debian.org/debian".
+func ParseRoute(spec string) (*Route, error) {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		return nil, errors.New("invalid route, expected match=upstream: " + spec)
+	}
+	match, upstream := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if upstream == "" {
+		return nil, errors.New("invalid route, missing upstream: " + spec)
+	}
+	if match == "" {
+		return nil, errors.New("invalid route, missing host or path prefix: " + spec)
+	}
+
+	route := &Route{
+		// The name is the groupcache group, which peers read from the first
+		// segment of a request path, so it must not contain a slash.
+		Name:     "route:" + url.PathEscape(match),
+		Upstream: strings.TrimRight(upstream, "/"),
+	}
+	host := match
+	if j := strings.Index(match, "/"); j >= 0 {
+		host = match[:j]
+		route.PathPrefix = strings.Trim(match[j:], "/")
+	}
+	if host != "*" {
+		route.Host = strings.ToLower(host)
+	}
+	return route, nil
+}
+
+type Router struct {
+	routes []*Route
+}
+
+// NewRouter returns a Router that picks the most specific matching route:
+// routes with a Host win over host-less routes, then the longest path prefix.
+func NewRouter(routes ...*Route) *Router {
+	sorted := make([]*Route, len(routes))
+	copy(sorted, routes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if (sorted[i].Host != "") != (sorted[j].Host != "") {
+			return sorted[i].Host != ""
+		}
+		return len(sorted[i].PathPrefix) > len(sorted[j].PathPrefix)
+	})
+	return &Router{
+		routes: sorted,
+	}
+}
+
+// Match returns the route for the request and the request path relative to
+// the route's path prefix.
+func (router *Router) Match(host string, request string) (*Route, string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	request = strings.TrimLeft(request, "/")
+
+	for _, route := range router.routes {
+		if route.Host != "" && route.Host != host {
+			continue
+		}
+		if route.PathPrefix == "" {
+			return route, request, nil
+		}
+		if request == route.PathPrefix {
+			return route, "", nil
+		}
+		if strings.HasPrefix(request, route.PathPrefix+"/") {
+			return route, request[len(route.PathPrefix)+1:], nil
+		}
+	}
+	return nil, "", NoRoute{}
+}
+
+// Routes returns the routes in match order.
+func (router *Router) Routes() []*Route {
+	return router.routes
+}
@@ -0,0 +1,58 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRoute(t *testing.T) {
+	route, err := ParseRoute("Repo.Example.com/maven/=https://repo1.maven.org/maven2/")
+	assert.Nil(t, err)
+	assert.Equal(t, "repo.example.com", route.Host)
+	assert.Equal(t, "maven", route.PathPrefix)
+	assert.Equal(t, "https://repo1.maven.org/maven2", route.Upstream)
+
+	route, err = ParseRoute("/debian=http://deb.debian.org/debian")
+	assert.Nil(t, err)
+	assert.Equal(t, "", route.Host)
+	assert.Equal(t, "debian", route.PathPrefix)
+	assert.Equal(t, "route:%2Fdebian", route.Name, "group names have no slash")
+
+	_, err = ParseRoute("http://upstream")
+	assert.NotNil(t, err)
+	_, err = ParseRoute("example.com=")
+	assert.NotNil(t, err)
+}
+
+func TestMatch(t *testing.T) {
+	var routes []*Route
+	for _, spec := range []string{
+		"/maven=http://maven",
+		"a.example.com=http://a",
+		"a.example.com/maven=http://a-maven",
+	} {
+		route, err := ParseRoute(spec)
+		assert.Nil(t, err)
+		routes = append(routes, route)
+	}
+	router := NewRouter(routes...)
+
+	route, request, err := router.Match("a.example.com:8080", "maven/org/foo.jar")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://a-maven", route.Upstream)
+	assert.Equal(t, "org/foo.jar", request)
+
+	route, request, err = router.Match("A.example.com", "mavenish/foo.jar")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://a", route.Upstream)
+	assert.Equal(t, "mavenish/foo.jar", request)
+
+	route, request, err = router.Match("b.example.com", "maven/org/foo.jar")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://maven", route.Upstream)
+	assert.Equal(t, "org/foo.jar", request)
+
+	_, _, err = router.Match("b.example.com", "debian/foo.deb")
+	assert.Equal(t, NoRoute{}, err)
+}
@@ -30,6 +30,13 @@ func NewMultiReaderAt(parts ...SizeReaderAt) SizeReaderAt {
 
 // END_1 OMIT
 
+// A RangeWriterTo writes length bytes starting at off to w. Readers backed
+// by files implement it so w can take the bytes straight from the file,
+// e.g. with sendfile.
+type RangeWriterTo interface {
+	WriteRangeTo(w io.Writer, off, length int64) (int64, error)
+}
+
 type offsetAndSource struct {
 	off int64
 	SizeReaderAt
@@ -85,6 +92,44 @@ func (m *multi) ReadAt(p []byte, off int64) (n int, err error) {
 	return
 }
 
+// WriteRangeTo writes each part of the range in turn, through the part's
+// own WriteRangeTo when it has one.
+func (m *multi) WriteRangeTo(w io.Writer, off, length int64) (written int64, err error) {
+	for _, part := range m.parts {
+		if length <= 0 {
+			break
+		}
+		partEnd := part.off + part.Size()
+		if partEnd <= off {
+			continue
+		}
+		start := off - part.off
+		n := partEnd - off
+		if n > length {
+			n = length
+		}
+		var pn int64
+		if ranged, ok := part.SizeReaderAt.(RangeWriterTo); ok {
+			pn, err = ranged.WriteRangeTo(w, start, n)
+		} else {
+			pn, err = io.Copy(w, io.NewSectionReader(part.SizeReaderAt, start, n))
+		}
+		written += pn
+		off += pn
+		length -= pn
+		if err != nil {
+			return written, err
+		}
+		if pn != n {
+			return written, io.ErrUnexpectedEOF
+		}
+	}
+	if length > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return written, err
+}
+
 //// NewChunkAlignedReaderAt returns a ReaderAt wrapper that is backed
 //// by a ReaderAt r of size totalSize where the wrapper guarantees that
 //// all ReadAt calls are aligned to chunkSize boundaries and of size
@@ -1 +1,42 @@
 package sizereaderat
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rangeWriter records the ranges written through WriteRangeTo.
+type rangeWriter struct {
+	*io.SectionReader
+	ranges [][2]int64
+}
+
+func (r *rangeWriter) WriteRangeTo(w io.Writer, off, length int64) (int64, error) {
+	r.ranges = append(r.ranges, [2]int64{off, length})
+	return io.Copy(w, io.NewSectionReader(r.SectionReader, off, length))
+}
+
+func TestMultiWriteRangeTo(t *testing.T) {
+	ranged := &rangeWriter{SectionReader: io.NewSectionReader(strings.NewReader("world"), 0, 5)}
+	reader := NewMultiReaderAt(
+		io.NewSectionReader(strings.NewReader("hello "), 0, 6),
+		ranged,
+		io.NewSectionReader(strings.NewReader("!"), 0, 1),
+	)
+
+	var buf bytes.Buffer
+	n, err := reader.(RangeWriterTo).WriteRangeTo(&buf, 3, 9)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9), n)
+	assert.Equal(t, "lo world!", buf.String())
+	assert.Equal(t, [][2]int64{{0, 5}}, ranged.ranges)
+
+	buf.Reset()
+	n, err = reader.(RangeWriterTo).WriteRangeTo(&buf, 10, 5)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, "d!", buf.String())
+}
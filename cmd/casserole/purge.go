@@ -0,0 +1,66 @@
+// Copyright © 2016 Frederick F. Kautz IV fkautz@alumni.cmu.edu
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// purge implements "casserole purge", a client for the admin purge api.
+func purge(args []string) int {
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	admin := flags.String("admin", "http://localhost:8081", "Admin address of any casserole node")
+	purgeUrl := flags.String("url", "", "Purge a single url, e.g. http://host/path")
+	prefix := flags.String("prefix", "", "Purge every url under a prefix, e.g. http://host/path/")
+	regex := flags.String("regex", "", "Purge every upstream path matching a regular expression")
+	blocks := flags.Bool("blocks", false, "Also remove the disk blocks of purged objects on every node")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	form := url.Values{}
+	switch {
+	case *purgeUrl != "":
+		form.Set("url", *purgeUrl)
+	case *prefix != "":
+		form.Set("prefix", *prefix)
+	case *regex != "":
+		form.Set("regex", *regex)
+	default:
+		fmt.Fprintln(os.Stderr, "one of -url, -prefix or -regex is required")
+		flags.Usage()
+		return 2
+	}
+	if *blocks {
+		form.Set("blocks", "true")
+	}
+
+	resp, err := http.PostForm(*admin+"/purge", form)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
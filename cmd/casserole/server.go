@@ -15,19 +15,24 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
-	"github.com/fkautz/casserole/cmd"
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/fkautz/casserole/cache/diskcache"
 	"github.com/fkautz/casserole/cache/httpserver"
 	"github.com/fkautz/casserole/cache/hydrator"
+	"github.com/fkautz/casserole/cache/membership"
 	"github.com/fkautz/casserole/cache/memorycache"
+	"github.com/fkautz/casserole/cache/router"
+	"github.com/fkautz/casserole/cmd"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var config cmd.Config
@@ -35,6 +40,10 @@ var config cmd.Config
 func main() {
 	log.SetFlags(log.Flags() | log.Lshortfile)
 
+	if len(os.Args) > 1 && os.Args[1] == "purge" {
+		os.Exit(purge(os.Args[2:]))
+	}
+
 	err := envconfig.Process("casserole", &config)
 	if err != nil {
 		log.Fatal(err.Error())
@@ -52,7 +61,26 @@ func main() {
 		if err != nil {
 			log.Fatalln("Unable to parse cleaned-disk-usage", err)
 		}
-		persistentCache, err = diskcache.New(config.DiskCacheDir, int64(maxSize), int64(cleanedSize))
+		var store diskcache.Store
+		switch config.DiskCacheStore {
+		case "files":
+			if _, err := diskcache.NewPolicy(config.DiskCachePolicy); err != nil {
+				log.Fatalln(err)
+			}
+			store = func(root string, maxSize int64, cleanedSize int64) (diskcache.Cache, error) {
+				policy, _ := diskcache.NewPolicy(config.DiskCachePolicy)
+				return diskcache.NewWithPolicy(root, maxSize, cleanedSize, policy)
+			}
+		case "segments":
+			store = diskcache.NewSegments
+		default:
+			log.Fatalln("Unknown disk cache store", config.DiskCacheStore)
+		}
+		if len(config.DiskCacheDirs) > 0 {
+			persistentCache, err = newVolumes(config.DiskCacheDirs, maxSize, cleanedSize, store)
+		} else {
+			persistentCache, err = store(config.DiskCacheDir, int64(maxSize), int64(cleanedSize))
+		}
 		if err != nil {
 			log.Fatalln("Unable to initialize disk cache", err)
 		}
@@ -63,19 +91,69 @@ func main() {
 		log.Fatalln("Unable to parse max-memory-usage", err)
 	}
 
-	cacheConfig := gcache.Config{
-		MaxMemoryUsage: int64(maxMemory),
-		BlockSize:      blockSize,
-		DiskCache:      persistentCache,
-		Hydrator:       hydrator.NewHydrator(config.MirrorUrl),
-		PeeringAddress: config.PeeringAddress,
-		Etcd:           config.Etcd,
-		PassThrough:    config.Passthrough,
+	cluster, err := newMembership(config)
+	if err != nil {
+		log.Fatalln("Unable to configure membership", err)
+	}
+
+	var routes []*router.Route
+	if len(config.Routes) > 0 {
+		for _, spec := range config.Routes {
+			route, err := router.ParseRoute(spec)
+			if err != nil {
+				log.Fatalln("Unable to parse route", err)
+			}
+			routes = append(routes, route)
+		}
+	} else {
+		routes = append(routes, &router.Route{
+			Name:     "default",
+			Upstream: strings.TrimRight(config.MirrorUrl, "/"),
+		})
+	}
+
+	// Zero means unbounded, so a bound smaller than the number of routes
+	// still keeps one entry per route.
+	maxMetadataEntries := config.MaxMetadataEntries / len(routes)
+	if config.MaxMetadataEntries > 0 && maxMetadataEntries < 1 {
+		maxMetadataEntries = 1
 	}
 
-	cache := gcache.NewCache(cacheConfig)
+	for _, route := range routes {
+		log.Println("Route:", route.Name, "->", route.Upstream)
+		cacheConfig := gcache.Config{
+			MaxMemoryUsage:     int64(maxMemory) / int64(len(routes)),
+			BlockSize:          blockSize,
+			DiskCache:          persistentCache,
+			Hydrator:           hydrator.NewHydrator(route.Upstream),
+			GroupName:          route.Name,
+			PeeringAddress:     config.PeeringAddress,
+			Membership:         cluster,
+			Etcd:               config.Etcd,
+			EtcdPrefix:         "/casserole/" + config.Cluster + "/metadata/",
+			PassThrough:        config.Passthrough,
+			StaleIfError:       config.StaleIfError,
+			MaxMetadataEntries: maxMetadataEntries,
+			DirectDiskReads:    config.DirectDiskReads,
+			PeerSecret:         config.PeerSecret,
+		}
+		route.Cache = gcache.NewCache(cacheConfig)
+	}
 
-	cacheHandler := httpserver.NewHttpHandler(config, cache, blockSize)
+	routeTable := router.NewRouter(routes...)
+	cacheHandler := httpserver.NewHttpHandler(config, routeTable, blockSize)
+
+	if config.AdminAddress != "" {
+		go func() {
+			adminRouter := http.NewServeMux()
+			adminRouter.Handle("/metrics", promhttp.Handler())
+			adminRouter.Handle("/", httpserver.NewAdminHandler(routeTable))
+			adminHandler := handlers.LoggingHandler(os.Stderr, adminRouter)
+			if err := http.ListenAndServe(config.AdminAddress, adminHandler); err != nil {
+				log.Fatalln(err)
+			}
+		}()
+	}
 
 	router := mux.NewRouter()
 
@@ -94,3 +172,83 @@ func main() {
 	}
 
 }
+
+// newMembership picks how this node finds its peers.
+func newMembership(config cmd.Config) (membership.Membership, error) {
+	mode := config.Membership
+	if mode == "" {
+		switch {
+		case len(config.Etcd) > 0:
+			mode = "etcd"
+		case len(config.Peers) > 0:
+			mode = "static"
+		case config.DnsName != "":
+			mode = "dns"
+		case config.KubernetesService != "":
+			mode = "kubernetes"
+		default:
+			mode = "standalone"
+		}
+	}
+	log.Println("Membership:", mode)
+
+	switch mode {
+	case "standalone":
+		return membership.Standalone{}, nil
+	case "static":
+		if len(config.Peers) == 0 {
+			return nil, errors.New("static membership requires peers")
+		}
+		return membership.NewStatic(config.Peers), nil
+	case "etcd":
+		if len(config.Etcd) == 0 {
+			return nil, errors.New("etcd membership requires etcd endpoints")
+		}
+		return membership.NewEtcd(config.Etcd, peersKey(config.Cluster)), nil
+	case "dns":
+		if config.DnsName == "" {
+			return nil, errors.New("dns membership requires a dns name")
+		}
+		return membership.NewDNS(config.DnsName, config.DiscoveryInterval), nil
+	case "kubernetes":
+		if config.KubernetesService == "" {
+			return nil, errors.New("kubernetes membership requires a service")
+		}
+		return membership.NewKubernetes(config.KubernetesService, config.KubernetesPort)
+	default:
+		return nil, errors.New("unknown membership: " + mode)
+	}
+}
+
+// peersKey is where nodes of a cluster register in etcd. The default cluster
+// keeps the key used before clusters were named, so old and new nodes form
+// one ring during a rolling upgrade.
+func peersKey(cluster string) string {
+	if cluster == "" || cluster == "default" {
+		return "/casserole/peers"
+	}
+	return "/casserole/" + cluster + "/peers"
+}
+
+// newVolumes parses "dir=size" disk cache roots. Each root is cleaned to the
+// same fraction of its size as CleanedDiskUsage is of MaxDiskUsage.
+func newVolumes(specs []string, maxSize, cleanedSize uint64, store diskcache.Store) (diskcache.Cache, error) {
+	var volumes []diskcache.Volume
+	for _, spec := range specs {
+		root, size := spec, maxSize
+		if i := strings.LastIndex(spec, "="); i >= 0 {
+			var err error
+			root = spec[:i]
+			size, err = bytefmt.ToBytes(spec[i+1:])
+			if err != nil {
+				return nil, errors.New("invalid disk cache dir " + spec + ": " + err.Error())
+			}
+		}
+		volumes = append(volumes, diskcache.Volume{
+			Root:        root,
+			MaxSize:     int64(size),
+			CleanedSize: int64(float64(size) * float64(cleanedSize) / float64(maxSize)),
+		})
+	}
+	return diskcache.NewVolumes(volumes, store)
+}
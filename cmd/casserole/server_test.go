@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fkautz/casserole/cache/membership"
+	"github.com/fkautz/casserole/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeersKey(t *testing.T) {
+	assert.Equal(t, "/casserole/peers", peersKey("default"))
+	assert.Equal(t, "/casserole/peers", peersKey(""))
+	assert.Equal(t, "/casserole/staging/peers", peersKey("staging"))
+}
+
+func TestNewMembership(t *testing.T) {
+	// not running in kubernetes, so picking kubernetes fails
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+
+	peers := []string{"http://10.0.0.1:8000", "http://10.0.0.2:8000"}
+	etcd := []string{"http://etcd:2379"}
+	tests := []struct {
+		name     string
+		config   cmd.Config
+		expected membership.Membership
+		err      string
+	}{
+		{"default", cmd.Config{}, membership.Standalone{}, ""},
+		{"standalone", cmd.Config{Membership: "standalone", Peers: peers}, membership.Standalone{}, ""},
+		{"peers", cmd.Config{Peers: peers}, membership.Static{Peers: peers}, ""},
+		{"etcd", cmd.Config{Etcd: etcd, Peers: peers, Cluster: "default"}, membership.Etcd{Endpoints: etcd, Prefix: "/casserole/peers"}, ""},
+		{"etcd cluster", cmd.Config{Membership: "etcd", Etcd: etcd, Cluster: "staging"}, membership.Etcd{Endpoints: etcd, Prefix: "/casserole/staging/peers"}, ""},
+		{"dns", cmd.Config{DnsName: "casserole", DiscoveryInterval: time.Minute}, membership.DNS{Name: "casserole", Interval: time.Minute, Resolver: net.DefaultResolver}, ""},
+		{"kubernetes", cmd.Config{KubernetesService: "default/casserole"}, nil, "not running in kubernetes, KUBERNETES_SERVICE_HOST is not set"},
+		{"static without peers", cmd.Config{Membership: "static"}, nil, "static membership requires peers"},
+		{"etcd without endpoints", cmd.Config{Membership: "etcd"}, nil, "etcd membership requires etcd endpoints"},
+		{"dns without name", cmd.Config{Membership: "dns"}, nil, "dns membership requires a dns name"},
+		{"kubernetes without service", cmd.Config{Membership: "kubernetes"}, nil, "kubernetes membership requires a service"},
+		{"unknown", cmd.Config{Membership: "gossip"}, nil, "unknown membership: gossip"},
+	}
+	for _, test := range tests {
+		cluster, err := newMembership(test.config)
+		if test.err != "" {
+			if assert.NotNil(t, err, test.name) {
+				assert.Equal(t, test.err, err.Error(), test.name)
+			}
+			continue
+		}
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, test.expected, cluster, test.name)
+	}
+}
@@ -14,15 +14,63 @@
 
 package cmd
 
+import "time"
+
 type Config struct {
-	Address string `default:"localhost:8080"`
+	Address          string `default:"localhost:8080"`
 	CleanedDiskUsage string `default:"800M"`
-	DiskCacheDir string `default:"./data"`
-	DiskCacheEnabled bool `default:"true"`
-	MaxDiskUsage string `default:"1G"`
-	MaxMemoryUsage string `default:"100M"`
-	MirrorUrl string `default:"http://localhost:9000"`
-	PeeringAddress string `default"http://localhost:8000"`
-	Etcd []string `default:""`
-	Passthrough []string `default:""`
-}
\ No newline at end of file
+	DiskCacheDir     string `default:"./data"`
+	// DiskCacheDirs spreads the disk cache over several roots, e.g. one
+	// per disk, as "dir=size" or "dir" for MaxDiskUsage. When set,
+	// DiskCacheDir is not used.
+	DiskCacheDirs    []string `default:""`
+	DiskCacheEnabled bool     `default:"true"`
+	// DiskCacheStore is "files", a file per block, or "segments", blocks
+	// appended to large segment files.
+	DiskCacheStore string `default:"files"`
+	// DiskCachePolicy picks which blocks the files store keeps: "lru",
+	// "lfu", "gdsf", "tinylfu" or "expired-first".
+	DiskCachePolicy string `default:"lru"`
+	// DirectDiskReads sends blocks this node owns straight from their file
+	// on disk, with sendfile where possible. Ignored by the segments store.
+	DirectDiskReads bool   `default:"true"`
+	MaxDiskUsage    string `default:"1G"`
+	MaxMemoryUsage  string `default:"100M"`
+	MirrorUrl       string `default:"http://localhost:9000"`
+	PeeringAddress  string `default:"http://localhost:8000"`
+	// PeerSecret authenticates invalidations, e.g. purges, between nodes.
+	// When empty, they are only accepted from the addresses of peers.
+	PeerSecret string `default:""`
+	// Membership is "standalone", "static" (Peers), "etcd", "dns" (DnsName)
+	// or "kubernetes" (KubernetesService). When empty it is picked from
+	// whichever of those is set, falling back to standalone.
+	Membership string   `default:""`
+	Peers      []string `default:""`
+	Etcd       []string `default:""`
+	// Cluster names the etcd keyspace, /casserole/<cluster>/, so several
+	// clusters can share one etcd.
+	Cluster string `default:"default"`
+	// DnsName is looked up as SRV records when it starts with an
+	// underscore and as A/AAAA records otherwise.
+	DnsName           string        `default:""`
+	DiscoveryInterval time.Duration `default:"30s"`
+	// KubernetesService is the "namespace/name" of the service whose
+	// endpoints are the peers. KubernetesPort names the endpoint port,
+	// otherwise the port of PeeringAddress is used.
+	KubernetesService string   `default:""`
+	KubernetesPort    string   `default:""`
+	Passthrough       []string `default:""`
+	// Routes map a host and/or path prefix to an upstream, e.g.
+	// "repo.example.com/maven=https://repo1.maven.org/maven2". When set,
+	// MirrorUrl is not used and unmatched requests are rejected.
+	Routes []string `default:""`
+	// StaleIfError is how long expired content may be served while the
+	// upstream is unreachable, unless the upstream says otherwise.
+	StaleIfError time.Duration `default:"1h"`
+	// AdminAddress serves the administrative api, e.g. purging. It should
+	// not be reachable by cache clients.
+	AdminAddress string `default:"localhost:8081"`
+	// MaxMetadataEntries bounds the metadata kept in memory, shared evenly
+	// between routes. Zero means unbounded.
+	MaxMetadataEntries int `default:"1000000"`
+}
@@ -5,29 +5,56 @@ import (
 	_ "bytes"
 	_ "code.cloudfoundry.org/bytefmt"
 	_ "container/heap"
+	_ "container/list"
+	_ "context"
+	_ "crypto/md5"
+	_ "crypto/sha1"
 	_ "crypto/sha256"
+	_ "crypto/sha512"
+	_ "crypto/subtle"
 	_ "crypto/tls"
+	_ "crypto/x509"
+	_ "encoding/base64"
+	_ "encoding/binary"
 	_ "encoding/gob"
 	_ "encoding/hex"
 	_ "encoding/json"
 	_ "errors"
+	_ "flag"
+	_ "fmt"
 	_ "github.com/boltdb/bolt"
 	_ "github.com/coreos/etcd/client"
 	_ "github.com/coreos/etcd/clientv3"
+	_ "github.com/coreos/etcd/etcdserver/etcdserverpb"
 	_ "github.com/coreos/etcd/mvcc/mvccpb"
 	_ "github.com/fkautz/peertracker"
 	_ "github.com/golang/groupcache"
+	_ "github.com/golang/groupcache/consistenthash"
+	_ "github.com/golang/groupcache/groupcachepb"
+	_ "github.com/golang/groupcache/lru"
+	_ "github.com/golang/protobuf/proto"
 	_ "github.com/gorilla/handlers"
 	_ "github.com/gorilla/mux"
 	_ "github.com/kelseyhightower/envconfig"
 	_ "github.com/pquerna/cachecontrol/cacheobject"
+	_ "github.com/prometheus/client_golang/prometheus"
+	_ "github.com/prometheus/client_golang/prometheus/promhttp"
 	_ "github.com/stretchr/testify/assert"
 	_ "github.com/stretchr/testify/mock"
 	_ "golang.org/x/net/context"
+	_ "hash"
+	_ "hash/fnv"
 	_ "io"
 	_ "io/ioutil"
 	_ "log"
+	_ "math"
+	_ "mime"
+	_ "mime/multipart"
+	_ "net"
 	_ "net/http"
+	_ "net/http/httptest"
+	_ "net/textproto"
+	_ "net/url"
 	_ "os"
 	_ "path"
 	_ "regexp"
@@ -35,6 +62,7 @@ import (
 	_ "strconv"
 	_ "strings"
 	_ "sync"
+	_ "syscall"
 	_ "testing"
 	_ "time"
 )